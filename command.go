@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"natok-cli/conf"
+	"natok-cli/core"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Command 查询运行中的natok-cli：status 连接状态，tunnels 存活的隧道
+func Command(name string, args []string) int {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	jsonOut := flags.Bool("json", false, "print raw json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	// 读取配置时不输出路径解析等提示
+	log.SetLevel(log.WarnLevel)
+	path := conf.AppConf().Natok.ControlSocket
+	if path == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "control socket is disabled, set control-socket in conf.yaml")
+		return 1
+	}
+	api := map[string]string{"status": "/api/status", "tunnels": "/api/tunnels"}[name]
+	body, err := controlGet(path, api)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "natok-cli is not running or unreachable at %s: %v\n", path, err)
+		return 1
+	}
+	if *jsonOut {
+		_, _ = os.Stdout.Write(body)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer func() { _ = w.Flush() }()
+	if name == "status" {
+		var status core.StatusInfo
+		if err = json.Unmarshal(body, &status); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(w, "Started:\t%s\nUptime:\t%s\n\n", status.Start.Format("2006-01-02 15:04:05"), status.Uptime)
+		_, _ = fmt.Fprintln(w, "SERVER\tSTATE\tSINCE\tRECONNECTS\tTUNNELS\tFEATURES")
+		for _, s := range status.Servers {
+			state := "disconnected"
+			if s.Paused {
+				state = "paused"
+			} else if s.Connected {
+				state = "connected"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", s.Addr, state, s.Since.Format("2006-01-02 15:04:05"),
+				s.Reconnects, s.Tunnels, strings.Join(s.Features, ","))
+		}
+		return 0
+	}
+	var tunnels []core.TunnelInfo
+	if err = json.Unmarshal(body, &tunnels); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, _ = fmt.Fprintln(w, "SERIAL\tSERVER\tSTATE\tSOURCE\tTARGET\tAGE\tIN\tOUT")
+	for _, t := range tunnels {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", t.Serial, t.Server, t.State, t.Source, t.Target, t.Age, t.BytesIn, t.BytesOut)
+	}
+	return 0
+}
+
+// controlGet 经由本地控制套接字请求运行中的natok-cli
+func controlGet(path, api string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://natok-cli" + api)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io"
@@ -9,9 +10,32 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-var AppConf *AppConfig
+// 当前配置，重新加载时整体替换
+var (
+	appConf  atomic.Pointer[AppConfig]
+	reloadMu sync.Mutex
+	loadOnce sync.Once
+)
+
+// AppConf 当前配置，每次读取以获得重新加载后的配置；未经Init初始化时仅读取配置，不设置日志
+func AppConf() *AppConfig {
+	if appConfig := appConf.Load(); appConfig != nil {
+		return appConfig
+	}
+	loadOnce.Do(func() {
+		appConfig, err := Load()
+		if err != nil {
+			log.Error(err)
+			panic(err)
+		}
+		appConf.CompareAndSwap(nil, appConfig)
+	})
+	return appConf.Load()
+}
 
 // AppConfig 应用配置
 type AppConfig struct {
@@ -19,39 +43,213 @@ type AppConfig struct {
 }
 
 type Natok struct {
-	Server        []Server `yaml:"server"`          //服务器端
-	CertKeyPath   string   `yaml:"cert-key-path"`   //密钥路径
-	CertPemPath   string   `yaml:"cert-pem-path"`   //证书路径
-	LogFilePath   string   `yaml:"log-file-path"`   //日志路径
-	LogDebugLevel bool     `yaml:"log-debug-level"` //Debug日志
+	Server        []Server          `yaml:"server"`          //服务器端
+	Target        []Target          `yaml:"target"`          //内网目标
+	HealthAddr    string            `yaml:"health-addr"`     //健康状态查询地址
+	MetricsAddr   string            `yaml:"metrics-addr"`    //Prometheus监控指标地址
+	Admin         *AdminConf        `yaml:"admin"`           //本地管理接口
+	ControlSocket string            `yaml:"control-socket"`  //本地控制套接字，供status、tunnels命令使用，只读，为空时不启用
+	DrainTimeout  int               `yaml:"drain-timeout"`   //停止服务时等待隧道关闭的时长（秒），默认10
+	AccessLog     *AccessLogConf    `yaml:"access-log"`      //隧道访问日志
+	Udp           UdpConf           `yaml:"udp"`             //UDP隧道
+	Proxies       map[string]string `yaml:"proxies"`         //具名上游代理，供内网目标引用
+	Dns           *DnsConf          `yaml:"dns"`             //域名解析
+	Socket        *SocketConf       `yaml:"socket"`          //套接字选项，服务器与内网目标中可单独覆盖
+	CertKeyPath   string            `yaml:"cert-key-path"`   //密钥路径
+	CertPemPath   string            `yaml:"cert-pem-path"`   //证书路径
+	LogFilePath   string            `yaml:"log-file-path"`   //日志路径
+	LogRotate     *RotateConf       `yaml:"log-rotate"`      //日志轮转，未配置时按100MB轮转并保留5个备份，收到SIGUSR1、SIGHUP时重新打开日志文件
+	LogFormat     string            `yaml:"log-format"`      //日志格式：text（默认）、json
+	LogLevel      string            `yaml:"log-level"`       //日志级别：trace、debug、info（默认）、warn、error
+	LogDebugLevel bool              `yaml:"log-debug-level"` //Debug日志，未配置log-level时等同debug
+	LogSyslog     *SyslogConf       `yaml:"log-syslog"`      //syslog输出，与日志文件相互独立
 }
 
 // Server NATOK服务配置
 type Server struct {
-	InetHost  string `yaml:"host"`       // 服务器地址
-	InetPort  int    `yaml:"port"`       // 服务器端口
-	AccessKey string `yaml:"access-key"` //访问秘钥
+	InetHost     string      `yaml:"host"`          // 服务器地址
+	InetPort     int         `yaml:"port"`          // 服务器端口
+	AccessKey    string      `yaml:"access-key"`    //访问秘钥
+	Proxy        string      `yaml:"proxy"`         //代理：http://、socks5:// 地址或具名代理，none为直连，为空时读取HTTPS_PROXY
+	Transport    string      `yaml:"transport"`     //传输方式：tcp（默认）、websocket、command、quic
+	Command      string      `yaml:"command"`       //command传输的外部命令，%h、%p替换为主机与端口
+	WebSocket    *WebSocket  `yaml:"websocket"`     //WebSocket传输
+	Quic         *QuicConf   `yaml:"quic"`          //QUIC传输
+	IpVersion    string      `yaml:"ip-version"`    //地址族偏好：v4、v6、auto（默认，IPv6与IPv4竞速）
+	LocalAddress string      `yaml:"local-address"` //本地地址，连接natok-server时绑定
+	Interface    string      `yaml:"interface"`     //本地网卡，连接natok-server时绑定网卡地址，不绑定网卡设备
+	Features     bool        `yaml:"features"`      //特性协商：健康状态上报、UDP数据报帧，需natok-server支持
+	Socket       *SocketConf `yaml:"socket"`        //套接字选项，覆盖全局配置
+}
+
+// WebSocket WebSocket传输配置
+type WebSocket struct {
+	Scheme             string            `yaml:"scheme"`               // wss（默认）或 ws
+	Path               string            `yaml:"path"`                 // 请求路径，默认为/
+	Origin             string            `yaml:"origin"`               // Origin请求头
+	Headers            map[string]string `yaml:"headers"`              // 附加请求头
+	InsecureSkipVerify bool              `yaml:"insecure-skip-verify"` // 跳过wss证书校验
+}
+
+// AdminConf 本地管理接口配置
+type AdminConf struct {
+	Addr        string `yaml:"addr"`         // 监听地址：127.0.0.1:7071 或 unix:///path/to/natok.sock
+	Token       string `yaml:"token"`        // 访问令牌，TCP监听时必填
+	AllowRemote bool   `yaml:"allow-remote"` // 允许TCP监听非回环地址，默认仅限localhost
+}
+
+// AccessLogConf 隧道访问日志配置，隧道关闭时按行写入JSON
+type AccessLogConf struct {
+	Path       string `yaml:"path"` // 文件路径，相对路径按程序目录解析
+	RotateConf `yaml:",inline"`
+}
+
+// RotateConf 日志轮转配置
+type RotateConf struct {
+	MaxSize    int  `yaml:"max-size"`    // 单个文件上限（MB），超出后轮转，0为不按大小轮转
+	MaxBackups int  `yaml:"max-backups"` // 保留的备份数量，0为不限
+	MaxAge     int  `yaml:"max-age"`     // 备份保留天数，0为不限
+	Interval   int  `yaml:"interval"`    // 按时长轮转（小时），0为仅按大小轮转
+	Compress   bool `yaml:"compress"`    // 以gzip压缩备份文件
+}
+
+// SyslogConf syslog输出配置
+type SyslogConf struct {
+	Addr     string `yaml:"addr"`     // 地址：unixgram:///dev/log（默认）、udp://host:514、tcp://host:601
+	Facility string `yaml:"facility"` // 设施：kern、user、daemon（默认）、local0~local7等
+	AppName  string `yaml:"app-name"` // 应用名称，默认natok-cli
+	Level    string `yaml:"level"`    // 发送的最低级别，默认与log-level一致
+}
+
+// DnsConf 域名解析配置，用于natok-server与内网目标
+type DnsConf struct {
+	Nameservers []string          `yaml:"nameservers"` // DNS服务器，为空时使用系统配置
+	Timeout     int               `yaml:"timeout"`     // 查询超时（秒），默认5
+	Tcp         bool              `yaml:"tcp"`         // 使用TCP查询
+	Hosts       map[string]string `yaml:"hosts"`       // 静态解析，多个地址以逗号分隔
+}
 
+// SocketConf 套接字选项，未配置的项使用系统默认值
+type SocketConf struct {
+	KeepAlive   int   `yaml:"keep-alive"`   // TCP保活间隔（秒），负数为禁用
+	NoDelay     *bool `yaml:"no-delay"`     // TCP_NODELAY，默认开启
+	ReadBuffer  int   `yaml:"read-buffer"`  // 接收缓冲区（字节）
+	WriteBuffer int   `yaml:"write-buffer"` // 发送缓冲区（字节）
+	BufferSize  int   `yaml:"buffer-size"`  // 单次读取缓冲大小（字节），默认65536
 }
 
-// AppConfig Load 加载配置
-func init() {
+// QuicConf QUIC传输配置
+type QuicConf struct {
+	KeepAlive        int  `yaml:"keep-alive"`        // 保活间隔（秒），默认10
+	IdleTimeout      int  `yaml:"idle-timeout"`      // 空闲超时（秒），默认30
+	DisableMigration bool `yaml:"disable-migration"` // 禁用出口地址变化时的连接迁移
+}
+
+// Target 内网目标配置
+type Target struct {
+	Addr          string       `yaml:"addr"`           // 内网地址，与natok-server下发的地址对应
+	Backends      []string     `yaml:"backends"`       // 后端地址，按健康状态轮询
+	HealthCheck   *HealthCheck `yaml:"health-check"`   // 健康检查
+	ProxyProtocol string       `yaml:"proxy-protocol"` // PROXY协议头：v1、v2
+	Http          *HttpConf    `yaml:"http"`           // HTTP转发，改写请求头
+	Sni           []SniRoute   `yaml:"sni"`            // TLS透传，按SNI路由
+	Udp           *UdpConf     `yaml:"udp"`            // UDP隧道，覆盖全局配置
+	Tls           *TlsConf     `yaml:"tls"`            // 以TLS连接内网服务
+	Proxy         string       `yaml:"proxy"`          // 上游代理：http://、socks5:// 地址或具名代理
+	LocalAddress  string       `yaml:"local-address"`  // 本地地址，连接内网服务时绑定
+	Interface     string       `yaml:"interface"`      // 本地网卡，连接内网服务时绑定网卡地址，不绑定网卡设备
+	Socket        *SocketConf  `yaml:"socket"`         // 套接字选项，覆盖全局配置
+}
+
+// TlsConf 内网TLS配置
+type TlsConf struct {
+	CaPath             string `yaml:"ca-path"`              // 自定义CA证书
+	ServerName         string `yaml:"server-name"`          // 覆盖SNI，默认为内网地址的主机名
+	CertPemPath        string `yaml:"cert-pem-path"`        // 客户端证书
+	CertKeyPath        string `yaml:"cert-key-path"`        // 客户端密钥
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"` // 跳过证书校验，用于自签名证书
+}
+
+// UdpConf UDP隧道配置
+type UdpConf struct {
+	IdleTimeout     int `yaml:"idle-timeout"`      // 会话空闲超时（秒），默认60
+	MaxDatagramSize int `yaml:"max-datagram-size"` // 最大数据报大小，默认65507
+}
+
+// SniRoute SNI路由配置
+type SniRoute struct {
+	Host string `yaml:"host"` // 匹配的SNI，支持*.example.com
+	Addr string `yaml:"addr"` // 本地服务地址
+}
+
+// HttpConf HTTP转发配置
+type HttpConf struct {
+	Host          string            `yaml:"host"`           // 改写的Host头，默认为内网地址
+	Proto         string            `yaml:"proto"`          // X-Forwarded-Proto，默认http
+	SetHeaders    map[string]string `yaml:"set-headers"`    // 添加或覆盖的请求头
+	RemoveHeaders []string          `yaml:"remove-headers"` // 移除的请求头
+	Routes        []HttpRoute       `yaml:"routes"`         // 路由表，按顺序匹配，未匹配时使用内网地址
+}
+
+// HttpRoute HTTP路由配置
+type HttpRoute struct {
+	Host        string `yaml:"host"`         // 匹配的Host，支持*.example.com
+	Path        string `yaml:"path"`         // 匹配的路径前缀
+	Addr        string `yaml:"addr"`         // 本地服务地址
+	RewriteHost string `yaml:"rewrite-host"` // 改写的Host头，默认为本地服务地址
+}
+
+// HealthCheck 健康检查配置
+type HealthCheck struct {
+	Type     string `yaml:"type"`     // 检查方式：tcp、http、payload
+	Interval int    `yaml:"interval"` // 检查间隔（秒）
+	Timeout  int    `yaml:"timeout"`  // 超时时长（秒）
+	Path     string `yaml:"path"`     // http检查路径
+	Send     string `yaml:"send"`     // payload检查发送内容
+	Expect   string `yaml:"expect"`   // 期望响应：http为状态码前缀，payload为响应前缀
+	Rise     int    `yaml:"rise"`     // 连续成功次数后标记为健康
+	Fall     int    `yaml:"fall"`     // 连续失败次数后标记为异常
+}
+
+// 未配置log-rotate时的默认轮转策略
+const (
+	DefaultLogMaxSize    = 100 // 单个文件上限100MB
+	DefaultLogMaxBackups = 5   // 保留5个备份
+)
+
+// LogRotate 日志轮转配置，未配置时按默认大小与备份数量轮转；显式配置为0时不轮转
+func LogRotate(cfg *RotateConf) RotateConf {
+	if cfg == nil {
+		return RotateConf{MaxSize: DefaultLogMaxSize, MaxBackups: DefaultLogMaxBackups}
+	}
+	return *cfg
+}
+
+// 绝对路径
+var compile = regexp.MustCompile("^/|^\\\\|^[a-zA-Z]:")
+
+// Load 读取conf.yaml，相对路径按程序目录解析
+func Load() (*AppConfig, error) {
 	baseDir := getCurrentAbPath()
 	// 读取文件内容
 	file, err := os.ReadFile(baseDir + "conf.yaml")
 	if err != nil {
-		log.Error(err)
-		panic(err)
+		return nil, err
 	}
 	// 利用json转换为AppConfig
 	appConfig := new(AppConfig)
-	err = yaml.Unmarshal(file, appConfig)
-	if err != nil {
-		log.Error(err)
-		panic(err)
+	if err = yaml.Unmarshal(file, appConfig); err != nil {
+		return nil, err
 	}
 	conf := &appConfig.Natok
-	compile, err := regexp.Compile("^/|^\\\\|^[a-zA-Z]:")
+	// 地址族偏好
+	for _, server := range conf.Server {
+		switch server.IpVersion {
+		case "", "auto", "v4", "v6":
+		default:
+			return nil, fmt.Errorf("invalid ip-version %q for server %s:%d, expected v4, v6 or auto", server.IpVersion, server.InetHost, server.InetPort)
+		}
+	}
 	// 密钥文件
 	if conf.CertKeyPath != "" && !compile.MatchString(conf.CertKeyPath) {
 		log.Infof("%s -> %s", conf.CertKeyPath, baseDir+conf.CertKeyPath)
@@ -62,33 +260,107 @@ func init() {
 		log.Infof("%s -> %s", conf.CertPemPath, baseDir+conf.CertPemPath)
 		conf.CertPemPath = baseDir + conf.CertPemPath
 	}
+	// 本地控制套接字，未配置时不启用
+	if conf.ControlSocket == "none" {
+		conf.ControlSocket = ""
+	}
+	if conf.ControlSocket != "" && !compile.MatchString(conf.ControlSocket) {
+		conf.ControlSocket = baseDir + conf.ControlSocket
+	}
+	// 访问日志文件
+	if conf.AccessLog != nil && conf.AccessLog.Path != "" && !compile.MatchString(conf.AccessLog.Path) {
+		conf.AccessLog.Path = baseDir + conf.AccessLog.Path
+	}
+	// 内网目标证书文件
+	for _, target := range conf.Target {
+		if target.Tls == nil {
+			continue
+		}
+		for _, path := range []*string{&target.Tls.CaPath, &target.Tls.CertPemPath, &target.Tls.CertKeyPath} {
+			if *path != "" && !compile.MatchString(*path) {
+				*path = baseDir + *path
+			}
+		}
+	}
+	return appConfig, nil
+}
+
+// Reload 重新加载配置，日志配置与natok-server列表须重启后生效
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	appConfig, err := Load()
+	if err != nil {
+		return err
+	}
+	appConfig.Natok.LogFilePath = AppConf().Natok.LogFilePath
+	appConf.Store(appConfig)
+	return nil
+}
+
+// Init 加载配置并设置日志输出，服务运行前调用；status、tunnels等查询命令不调用，不打开日志文件
+func Init() {
+	baseDir := getCurrentAbPath()
+	appConfig, err := Load()
+	if err != nil {
+		log.Error(err)
+		panic(err)
+	}
+	conf := &appConfig.Natok
 
 	// 日志记录配置
-	log.SetLevel(log.InfoLevel)
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp:   true,
-		ForceColors:     true,
-		TimestampFormat: "2006-01-02 15:04:05.000",
-	})
+	log.SetFormatter(logFormatter(conf.LogFormat, isTerminal(os.Stderr)))
+	level := log.InfoLevel
+	if conf.LogLevel != "" {
+		if level, err = log.ParseLevel(conf.LogLevel); err != nil {
+			log.Warnf("Invalid log-level %q, use info", conf.LogLevel)
+			level = log.InfoLevel
+		}
+	} else if conf.LogDebugLevel {
+		level = log.DebugLevel
+	}
+	// syslog输出，级别可与log-level不同，日志级别取两者中较详细的一个，文件与终端按log-level过滤
+	loggerLevel := level
+	var syslogHook *SyslogHook
+	if conf.LogSyslog != nil {
+		if syslogHook, err = NewSyslogHook(conf.LogSyslog, level); err != nil {
+			log.Errorf("Syslog config failed, Error: %+v", err)
+		} else if syslogHook.Level() > loggerLevel {
+			loggerLevel = syslogHook.Level()
+		}
+	}
+	log.SetLevel(loggerLevel)
 	// 在输出日志中添加文件名和方法信息
-	if appConfig.Natok.LogDebugLevel {
+	if level >= log.DebugLevel {
 		log.SetReportCaller(true)
-		log.SetLevel(log.DebugLevel)
 	}
 	// 日志记录输出文件
-	if conf.LogFilePath != "" && !compile.MatchString(conf.LogFilePath) {
-		log.Infof("%s -> %s", conf.LogFilePath, baseDir+conf.LogFilePath)
-		conf.LogFilePath = baseDir + conf.LogFilePath
-		logFile, err := os.OpenFile(conf.LogFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if conf.LogFilePath != "" {
+		if !compile.MatchString(conf.LogFilePath) {
+			log.Infof("%s -> %s", conf.LogFilePath, baseDir+conf.LogFilePath)
+			conf.LogFilePath = baseDir + conf.LogFilePath
+		}
+		rotate := LogRotate(conf.LogRotate)
+		logFile, err := NewRotateWriter(conf.LogFilePath, rotate)
 		if err != nil {
 			log.Fatal(err)
-		} else {
-			// 组合一下即可，os.Stdout代表标准输出流
-			multiWriter := io.MultiWriter(logFile, os.Stdout)
-			log.SetOutput(multiWriter)
 		}
+		// 文件与标准输出各自格式化，仅在标准输出为终端时着色
+		log.SetOutput(io.Discard)
+		log.AddHook(NewOutputHook(logFile, logFormatter(conf.LogFormat, false), level))
+		log.AddHook(NewOutputHook(os.Stdout, logFormatter(conf.LogFormat, isTerminal(os.Stdout)), level))
+		notifyReopen(logFile)
+		if rotate.MaxSize <= 0 && rotate.Interval <= 0 {
+			log.Warnf("Log rotation is off, %s grows without bound unless rotated externally", conf.LogFilePath)
+		}
+	} else {
+		log.SetOutput(io.Discard)
+		log.AddHook(NewOutputHook(os.Stderr, logFormatter(conf.LogFormat, isTerminal(os.Stderr)), level))
+	}
+	if syslogHook != nil {
+		log.AddHook(syslogHook)
 	}
-	AppConf = appConfig
+	appConf.Store(appConfig)
 }
 
 // 最终方案-全兼容
@@ -100,12 +372,15 @@ func getCurrentAbPath() string {
 	return dir + "/"
 }
 
-// 获取系统临时目录，兼容go run
+// 获取系统临时目录，兼容go run与go test
 func getTmpDir() string {
 	dir := os.Getenv("TEMP")
 	if dir == "" {
 		dir = os.Getenv("TMP")
 	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
 	res, _ := filepath.EvalSymlinks(dir)
 	return res
 }
@@ -0,0 +1,58 @@
+package conf
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"testing"
+)
+
+func TestAppConfLazy(t *testing.T) {
+	// 未调用Init时读取配置不设置日志输出
+	if AppConf() == nil {
+		t.Fatal("config not loaded")
+	}
+	for level, hooks := range log.StandardLogger().Hooks {
+		if len(hooks) > 0 {
+			t.Fatalf("log hooks installed without Init at %s: %d", level, len(hooks))
+		}
+	}
+}
+
+func TestReloadConcurrentRead(t *testing.T) {
+	logPath := AppConf().Natok.LogFilePath
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if AppConf() == nil {
+				t.Error("config missing during reload")
+			}
+		}()
+	}
+	wg.Wait()
+	// 日志配置须重启后生效，重新加载保留原值
+	if got := AppConf().Natok.LogFilePath; got != logPath {
+		t.Fatalf("log-file-path changed by reload: %q -> %q", logPath, got)
+	}
+}
+
+func TestLogRotateDefault(t *testing.T) {
+	// 未配置时按默认策略轮转，日志文件不会无限增长
+	if rotate := LogRotate(nil); rotate.MaxSize != DefaultLogMaxSize || rotate.MaxBackups != DefaultLogMaxBackups {
+		t.Fatalf("unexpected default rotation: %+v", rotate)
+	}
+	// 显式配置时按配置，全为0时不轮转
+	if rotate := LogRotate(&RotateConf{Interval: 24}); rotate.MaxSize != 0 || rotate.Interval != 24 {
+		t.Fatalf("configured rotation overridden: %+v", rotate)
+	}
+	if rotate := LogRotate(&RotateConf{}); rotate != (RotateConf{}) {
+		t.Fatalf("disabled rotation overridden: %+v", rotate)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package conf
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen 收到SIGUSR1、SIGHUP时重新打开日志文件，配合外部logrotate使用
+func notifyReopen(w *RotateWriter) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
+	go func() {
+		for sig := range ch {
+			if err := w.Reopen(); err != nil {
+				log.Errorf("Reopen log file failed, Signal: %s, Error: %+v", sig, err)
+			} else {
+				log.Infof("Log file reopened, Signal: %s", sig)
+			}
+		}
+	}()
+}
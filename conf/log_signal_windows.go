@@ -0,0 +1,6 @@
+//go:build windows
+
+package conf
+
+// notifyReopen Windows不支持SIGUSR1、SIGHUP，仅按配置轮转
+func notifyReopen(*RotateWriter) {}
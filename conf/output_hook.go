@@ -0,0 +1,68 @@
+package conf
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// OutputHook struct 将日志按各自的格式写入文件或终端，各输出独立判断是否着色
+type OutputHook struct {
+	mu        sync.Mutex
+	Writer    io.Writer     //输出
+	Formatter log.Formatter //格式
+	levels    []log.Level   //输出的级别
+}
+
+// NewOutputHook 创建日志输出，level为输出的最低级别
+func NewOutputHook(w io.Writer, formatter log.Formatter, level log.Level) *OutputHook {
+	h := &OutputHook{Writer: w, Formatter: formatter}
+	for _, item := range log.AllLevels {
+		if item <= level {
+			h.levels = append(h.levels, item)
+		}
+	}
+	return h
+}
+
+// Levels 输出的级别
+func (h *OutputHook) Levels() []log.Level {
+	return h.levels
+}
+
+// Fire 格式化并写入日志
+func (h *OutputHook) Fire(entry *log.Entry) error {
+	data, err := h.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.Writer.Write(data)
+	return err
+}
+
+// logFormatter 日志格式，colored为是否着色
+func logFormatter(format string, colored bool) log.Formatter {
+	if format == "json" {
+		return &log.JSONFormatter{TimestampFormat: "2006-01-02 15:04:05.000"}
+	}
+	return &log.TextFormatter{
+		FullTimestamp:   true,
+		TimestampFormat: "2006-01-02 15:04:05.000",
+		ForceColors:     colored,
+		DisableColors:   !colored,
+	}
+}
+
+// isTerminal 输出为终端，与logrus一致Windows控制台不着色
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok || runtime.GOOS == "windows" {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
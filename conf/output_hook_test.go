@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestOutputHookColors(t *testing.T) {
+	var file, console bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(log.DebugLevel)
+	logger.AddHook(NewOutputHook(&file, logFormatter("text", false), log.DebugLevel))
+	logger.AddHook(NewOutputHook(&console, logFormatter("text", true), log.InfoLevel))
+	logger.Debug("debug only in file")
+	logger.Warn("both outputs")
+
+	if strings.Contains(file.String(), "\x1b[") {
+		t.Fatalf("file output is colored: %q", file.String())
+	}
+	if !strings.Contains(file.String(), "debug only in file") || !strings.Contains(file.String(), "both outputs") {
+		t.Fatalf("file output missing entries: %q", file.String())
+	}
+	if !strings.Contains(console.String(), "\x1b[") {
+		t.Fatalf("terminal output is not colored: %q", console.String())
+	}
+	if strings.Contains(console.String(), "debug only in file") {
+		t.Fatalf("terminal output ignored its level: %q", console.String())
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	if isTerminal(&bytes.Buffer{}) {
+		t.Fatal("buffer reported as terminal")
+	}
+}
@@ -0,0 +1,208 @@
+package conf
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 备份文件时间戳格式
+const backupTimeFormat = "20060102-150405.000"
+
+// RotateWriter struct 按大小或时长轮转的日志文件，备份文件名追加时间戳
+type RotateWriter struct {
+	mu      sync.Mutex
+	cleanMu sync.Mutex
+	Path    string     //文件路径
+	Rotate  RotateConf //轮转配置
+	file    *os.File   //当前文件
+	size    int64      //当前文件大小
+	started time.Time  //当前文件开始写入的时间
+}
+
+// NewRotateWriter 打开日志文件，已存在时追加写入
+func NewRotateWriter(path string, rotate RotateConf) (*RotateWriter, error) {
+	w := &RotateWriter{Path: path, Rotate: rotate}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open 打开日志文件
+func (w *RotateWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file, w.size, w.started = file, info.Size(), w.startTime(info)
+	return nil
+}
+
+// startTime 当前文件开始写入的时间，重启或重新打开后不重新计时：
+// 已有内容时为最近一次轮转的备份时间，无备份时为文件修改时间
+func (w *RotateWriter) startTime(info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Now()
+	}
+	if list := w.backups(); len(list) > 0 && list[0].time.Before(info.ModTime()) {
+		return list[0].time
+	}
+	return info.ModTime()
+}
+
+// Write 写入日志，超出大小上限时先轮转
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size > 0 && w.expired(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size == 0 {
+		w.started = time.Now()
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// expired 写入后超出大小上限，或已超出轮转时长
+func (w *RotateWriter) expired(n int) bool {
+	if limit := int64(w.Rotate.MaxSize) << 20; limit > 0 && w.size+int64(n) > limit {
+		return true
+	}
+	interval := time.Duration(w.Rotate.Interval) * time.Hour
+	return interval > 0 && time.Since(w.started) >= interval
+}
+
+// Reopen 重新打开日志文件，用于外部logrotate移走文件之后
+func (w *RotateWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+// Close 关闭日志文件
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate 重命名当前文件为备份并重新打开
+func (w *RotateWriter) rotate() error {
+	_ = w.file.Close()
+	w.file = nil
+	prefix, ext := w.backupName()
+	name := prefix + time.Now().Format(backupTimeFormat) + ext
+	if err := os.Rename(w.Path, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	// 压缩与清理耗时较长，不阻塞写入
+	go func() {
+		w.cleanMu.Lock()
+		defer w.cleanMu.Unlock()
+		if w.Rotate.Compress {
+			compress(name)
+		}
+		w.cleanup()
+	}()
+	return nil
+}
+
+// compress 以gzip压缩备份文件，成功后删除原文件
+func compress(path string) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return
+	}
+	_ = src.Close()
+	_ = os.Remove(path)
+}
+
+// backupName 备份文件名前缀与扩展名，如 access.log -> access- .log
+func (w *RotateWriter) backupName() (string, string) {
+	ext := filepath.Ext(w.Path)
+	return strings.TrimSuffix(w.Path, ext) + "-", ext
+}
+
+// backup struct 备份文件
+type backup struct {
+	path string
+	time time.Time
+}
+
+// backups 备份文件列表，包括已压缩的备份，按时间由新到旧排序
+func (w *RotateWriter) backups() []backup {
+	prefix, ext := w.backupName()
+	matches, _ := filepath.Glob(prefix + "*" + ext)
+	compressed, _ := filepath.Glob(prefix + "*" + ext + ".gz")
+	var list []backup
+	for _, path := range append(matches, compressed...) {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(path, prefix), ".gz"), ext)
+		if t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local); err == nil {
+			list = append(list, backup{path: path, time: t})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].time.After(list[j].time) })
+	return list
+}
+
+// cleanup 删除超出数量或保留天数的备份
+func (w *RotateWriter) cleanup() {
+	cutoff := time.Now().Add(-time.Duration(w.Rotate.MaxAge) * 24 * time.Hour)
+	for i, item := range w.backups() {
+		if (w.Rotate.MaxBackups > 0 && i >= w.Rotate.MaxBackups) || (w.Rotate.MaxAge > 0 && item.time.Before(cutoff)) {
+			_ = os.Remove(item.path)
+		}
+	}
+}
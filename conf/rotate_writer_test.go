@@ -0,0 +1,61 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rotateFixture 已有内容的日志文件与一个备份，备份时间为age之前
+func rotateFixture(t *testing.T, age time.Duration) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "natok.log")
+	stamp := time.Now().Add(-age)
+	backup := filepath.Join(dir, "natok-"+stamp.Format(backupTimeFormat)+".log")
+	if err := os.WriteFile(backup, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("current\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRotateIntervalSurvivesRestart(t *testing.T) {
+	// 当前文件自2小时前的轮转开始写入，重启后仍按1小时轮转
+	path := rotateFixture(t, 2*time.Hour)
+	w, err := NewRotateWriter(path, RotateConf{Interval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if _, err = w.Write([]byte("after restart\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(w.backups()); got != 2 {
+		t.Fatalf("expected the restarted file to rotate, backups: %d", got)
+	}
+}
+
+func TestRotateIntervalReopen(t *testing.T) {
+	path := rotateFixture(t, 10*time.Minute)
+	w, err := NewRotateWriter(path, RotateConf{Interval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if err = w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(w.started) < 10*time.Minute {
+		t.Fatalf("reopen reset the rotation age: %s", time.Since(w.started))
+	}
+	if _, err = w.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(w.backups()); got != 1 {
+		t.Fatalf("rotated before the interval elapsed, backups: %d", got)
+	}
+}
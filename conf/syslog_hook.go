@@ -0,0 +1,169 @@
+package conf
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslog设施
+var syslogFacility = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// 日志级别对应的syslog严重性
+var syslogSeverity = map[log.Level]int{
+	log.PanicLevel: 1, // alert，emerg表示系统不可用，不用于单个程序
+	log.FatalLevel: 2, // crit
+	log.ErrorLevel: 3, // err
+	log.WarnLevel:  4, // warning
+	log.InfoLevel:  6, // info
+	log.DebugLevel: 7, // debug
+	log.TraceLevel: 7, // debug
+}
+
+// SyslogHook struct 以RFC 5424格式发送日志至syslog，与文件、标准输出相互独立
+type SyslogHook struct {
+	mu       sync.Mutex
+	Network  string      //网络类型：unixgram、udp、tcp
+	Addr     string      //syslog地址
+	Facility int         //设施
+	AppName  string      //应用名称
+	level    log.Level   //发送的最低级别
+	levels   []log.Level //发送的级别
+	hostname string      //主机名
+	queue    chan []byte //待发送的消息
+	conn     net.Conn    //syslog连接
+	failed   bool        //上次发送失败
+}
+
+// NewSyslogHook 创建syslog输出，level为发送的最低级别
+func NewSyslogHook(cfg *SyslogConf, level log.Level) (*SyslogHook, error) {
+	h := &SyslogHook{Network: "unixgram", Addr: "/dev/log", AppName: "natok-cli", queue: make(chan []byte, 1024)}
+	if cfg.Addr != "" {
+		h.Addr = cfg.Addr
+		if network, addr, ok := strings.Cut(cfg.Addr, "://"); ok {
+			h.Network, h.Addr = network, addr
+		}
+	}
+	switch h.Network {
+	case "unixgram", "udp", "tcp":
+	case "unix":
+		h.Network = "unixgram"
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", h.Network)
+	}
+	facility := cfg.Facility
+	if facility == "" {
+		facility = "daemon"
+	}
+	var ok bool
+	if h.Facility, ok = syslogFacility[strings.ToLower(facility)]; !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	if cfg.AppName != "" {
+		h.AppName = cfg.AppName
+	}
+	if cfg.Level != "" {
+		var err error
+		if level, err = log.ParseLevel(cfg.Level); err != nil {
+			return nil, err
+		}
+	}
+	h.level = level
+	for _, item := range log.AllLevels {
+		if item <= level {
+			h.levels = append(h.levels, item)
+		}
+	}
+	if h.hostname, _ = os.Hostname(); h.hostname == "" {
+		h.hostname = "-"
+	}
+	go h.run()
+	return h, nil
+}
+
+// Levels 发送的级别
+func (h *SyslogHook) Levels() []log.Level {
+	return h.levels
+}
+
+// Level 发送的最低级别，日志级别须不低于此级别才能送达
+func (h *SyslogHook) Level() log.Level {
+	return h.level
+}
+
+// Fire 发送日志，队列已满时丢弃；Fatal、Panic在程序退出前同步发送
+func (h *SyslogHook) Fire(entry *log.Entry) error {
+	msg := h.format(entry)
+	if entry.Level <= log.FatalLevel {
+		h.send(msg)
+		return nil
+	}
+	select {
+	case h.queue <- msg:
+	default:
+	}
+	return nil
+}
+
+// format RFC 5424：<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (h *SyslogHook) format(entry *log.Entry) []byte {
+	var sb strings.Builder
+	sb.WriteString(entry.Message)
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(&sb, " %s=%v", key, entry.Data[key])
+	}
+	pri := h.Facility*8 + syslogSeverity[entry.Level]
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.AppName, os.Getpid(), strings.TrimRight(sb.String(), "\n")))
+}
+
+// run 依次发送队列中的消息
+func (h *SyslogHook) run() {
+	for msg := range h.queue {
+		h.send(msg)
+	}
+}
+
+// send 发送消息，连接断开时重连一次；TCP按RFC 6587以长度前缀分帧
+func (h *SyslogHook) send(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		if h.conn == nil {
+			if h.conn, err = net.DialTimeout(h.Network, h.Addr, 5*time.Second); err != nil {
+				h.conn = nil
+				continue
+			}
+		}
+		if _, err = h.conn.Write(msg); err == nil {
+			h.failed = false
+			return
+		}
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+	// 不经由log输出，避免失败的日志再次进入队列
+	if !h.failed {
+		h.failed = true
+		_, _ = fmt.Fprintf(os.Stderr, "Syslog send failed, Addr: %s://%s, Error: %+v\n", h.Network, h.Addr, err)
+	}
+}
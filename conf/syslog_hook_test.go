@@ -0,0 +1,134 @@
+package conf
+
+import (
+	"bufio"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogLogger 仅输出至syslog的日志，级别为log-level与syslog级别中较详细的一个
+func syslogLogger(t *testing.T, cfg *SyslogConf, level log.Level) *log.Logger {
+	t.Helper()
+	hook, err := NewSyslogHook(cfg, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(max(level, hook.Level()))
+	logger.AddHook(hook)
+	return logger
+}
+
+// expectSyslog 校验RFC 5424消息
+func expectSyslog(t *testing.T, msg, pri, text string) {
+	t.Helper()
+	if !strings.HasPrefix(msg, pri+"1 ") || !strings.Contains(msg, " natok-test ") || !strings.HasSuffix(msg, text) {
+		t.Fatalf("unexpected syslog message: %q", msg)
+	}
+}
+
+// readDatagram 读取一个数据报
+func readDatagram(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	logger := syslogLogger(t, &SyslogConf{Addr: "udp://" + conn.LocalAddr().String(), AppName: "natok-test"}, log.InfoLevel)
+	logger.WithField("serial", "7").Warn("tunnel failed")
+	// daemon(3)*8 + warning(4)
+	expectSyslog(t, readDatagram(t, conn), "<28>", "tunnel failed serial=7")
+}
+
+func TestSyslogUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	logger := syslogLogger(t, &SyslogConf{Addr: "unix://" + path, Facility: "local0", AppName: "natok-test"}, log.InfoLevel)
+	logger.Info("started")
+	// local0(16)*8 + info(6)
+	expectSyslog(t, readDatagram(t, conn), "<134>", "started")
+}
+
+func TestSyslogTcpFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	frames := make(chan string, 4)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+		for {
+			// RFC 6587 长度前缀分帧：MSG-LEN SP SYSLOG-MSG
+			size, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil {
+				return
+			}
+			msg := make([]byte, n)
+			if _, err = io.ReadFull(reader, msg); err != nil {
+				return
+			}
+			frames <- string(msg)
+		}
+	}()
+	logger := syslogLogger(t, &SyslogConf{Addr: "tcp://" + listener.Addr().String(), AppName: "natok-test"}, log.InfoLevel)
+	logger.Error("first\nline")
+	logger.Warn("second")
+	for _, want := range []struct{ pri, text string }{{"<27>", "first\nline"}, {"<28>", "second"}} {
+		select {
+		case msg := <-frames:
+			expectSyslog(t, msg, want.pri, want.text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no tcp frame for %q", want.text)
+		}
+	}
+}
+
+func TestSyslogLevelBelowLogLevel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	// log-level为warn，syslog级别为debug时debug日志仍送达syslog
+	logger := syslogLogger(t, &SyslogConf{Addr: "udp://" + conn.LocalAddr().String(), AppName: "natok-test", Level: "debug"}, log.WarnLevel)
+	logger.Debug("verbose")
+	expectSyslog(t, readDatagram(t, conn), "<31>", "verbose")
+}
+
+func TestSyslogPanicSeverity(t *testing.T) {
+	if got := syslogSeverity[log.PanicLevel]; got != 1 {
+		t.Fatalf("panic maps to severity %d, want alert(1)", got)
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"sync"
+	"time"
+)
+
+// AccessEntry struct 访问日志，隧道关闭时写入一行
+type AccessEntry struct {
+	Serial   string    `json:"serial"`
+	Server   string    `json:"server"`
+	Network  string    `json:"network"`
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"` // 秒
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// 访问日志输出，重新加载配置时替换
+var (
+	accessMu  sync.Mutex
+	accessOut *conf.RotateWriter
+)
+
+// InitAccessLog 初始化访问日志，未配置路径时不记录
+func InitAccessLog(cfg *conf.AccessLogConf) {
+	var out *conf.RotateWriter
+	if cfg != nil && cfg.Path != "" {
+		rotate := cfg.RotateConf
+		if rotate.MaxSize <= 0 {
+			rotate.MaxSize = 100
+		}
+		var err error
+		if out, err = conf.NewRotateWriter(cfg.Path, rotate); err != nil {
+			log.Errorf("Access log open failed, Path: %s, Error: %+v", cfg.Path, err)
+		} else {
+			log.Infof("Access log: %s", cfg.Path)
+		}
+	}
+	accessMu.Lock()
+	old := accessOut
+	accessOut = out
+	accessMu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+// WriteAccess 写入访问日志
+func WriteAccess(entry AccessEntry) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	if accessOut == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Access log encode failed, Serial: %s, Error: %+v", entry.Serial, err)
+		return
+	}
+	if _, err = accessOut.Write(append(data, '\n')); err != nil {
+		log.Errorf("Access log write failed, Path: %s, Error: %+v", accessOut.Path, err)
+	}
+}
@@ -0,0 +1,211 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 启动时间
+var startTime = time.Now()
+
+// StatusInfo struct 运行状态
+type StatusInfo struct {
+	Start   time.Time     `json:"start"`
+	Uptime  string        `json:"uptime"`
+	Servers []ServerState `json:"servers"`
+}
+
+// AdminServe 本地管理接口，监听localhost或Unix域套接字
+func AdminServe(cfg *conf.AdminConf, reload func() error) {
+	listener, err := adminListen(cfg)
+	if err != nil {
+		log.Errorf("Admin listen failed, Addr: %s, Error: %+v", cfg.Addr, err)
+		return
+	}
+	log.Infof("Admin listen: %s", cfg.Addr)
+	if err = http.Serve(listener, adminAuth(cfg.Token, adminMux(reload))); err != nil {
+		log.Errorf("Admin listen failed, Addr: %s, Error: %+v", cfg.Addr, err)
+	}
+}
+
+// ControlServe 本地控制套接字，仅提供只读查询，依靠文件权限限制访问
+func ControlServe(path string) {
+	listener, err := listenUnix(path)
+	if err != nil {
+		log.Errorf("Control socket listen failed, Path: %s, Error: %+v", path, err)
+		return
+	}
+	log.Infof("Control socket listen: %s", path)
+	if err = http.Serve(listener, controlMux()); err != nil {
+		log.Errorf("Control socket listen failed, Path: %s, Error: %+v", path, err)
+	}
+}
+
+// controlMux 控制套接字路由，仅包含查询接口
+func controlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	queryRoutes(mux)
+	return mux
+}
+
+// adminMux 管理接口路由
+func adminMux(reload func() error) *http.ServeMux {
+	mux := http.NewServeMux()
+	queryRoutes(mux)
+	mux.HandleFunc("POST /api/servers/{addr}/pause", func(w http.ResponseWriter, r *http.Request) {
+		if handler := findServer(w, r.PathValue("addr")); handler != nil {
+			handler.Pause()
+			log.Infof("Natok server %s paused by admin", handler.Conf.Addr)
+			writeJson(w, http.StatusOK, handler.State())
+		}
+	})
+	mux.HandleFunc("POST /api/servers/{addr}/resume", func(w http.ResponseWriter, r *http.Request) {
+		if handler := findServer(w, r.PathValue("addr")); handler != nil {
+			handler.Resume()
+			log.Infof("Natok server %s resumed by admin", handler.Conf.Addr)
+			writeJson(w, http.StatusOK, handler.State())
+		}
+	})
+	mux.HandleFunc("DELETE /api/tunnels/{serial}", func(w http.ResponseWriter, r *http.Request) {
+		serial := r.PathValue("serial")
+		count := KillTunnel(serial, r.URL.Query().Get("server"))
+		if count == 0 {
+			writeJson(w, http.StatusNotFound, map[string]string{"error": "tunnel " + serial + " not found"})
+			return
+		}
+		log.Infof("Tunnel %s killed by admin, Count: %d", serial, count)
+		writeJson(w, http.StatusOK, map[string]int{"killed": count})
+	})
+	mux.HandleFunc("POST /api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := reload(); err != nil {
+			writeJson(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, map[string]bool{"reloaded": true})
+	})
+	return mux
+}
+
+// queryRoutes 查询接口：运行状态、natok-server列表与隧道列表
+func queryRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		status := StatusInfo{
+			Start:   startTime,
+			Uptime:  time.Since(startTime).Round(time.Second).String(),
+			Servers: make([]ServerState, 0),
+		}
+		for _, handler := range NatokServers() {
+			status.Servers = append(status.Servers, handler.State())
+		}
+		writeJson(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /api/servers", func(w http.ResponseWriter, r *http.Request) {
+		list := make([]ServerState, 0)
+		for _, handler := range NatokServers() {
+			list = append(list, handler.State())
+		}
+		writeJson(w, http.StatusOK, list)
+	})
+	mux.HandleFunc("GET /api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, Tunnels())
+	})
+}
+
+// unixListener struct Unix域套接字监听，关闭时删除套接字文件
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// listenUnix 监听Unix域套接字，仅当前用户可访问；残留的套接字文件无进程监听时才删除
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		_ = os.Remove(path)
+	}
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// adminListen 监听管理接口，TCP监听须配置令牌，非回环地址须显式允许
+func adminListen(cfg *conf.AdminConf) (net.Listener, error) {
+	if strings.HasPrefix(cfg.Addr, "unix://") {
+		return listenUnix(strings.TrimPrefix(cfg.Addr, "unix://"))
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("admin token is required for tcp listener")
+	}
+	if !cfg.AllowRemote && !loopbackAddr(cfg.Addr) {
+		return nil, fmt.Errorf("admin addr %s is not a loopback address, set allow-remote to listen on it", cfg.Addr)
+	}
+	return net.Listen("tcp", cfg.Addr)
+}
+
+// loopbackAddr 监听地址是否仅限本机：localhost或回环IP，空主机为全部网卡
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminAuth 校验访问令牌：Authorization: Bearer <token>
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJson(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// findServer 查找natok-server，未找到时返回404
+func findServer(w http.ResponseWriter, addr string) *NatokHandler {
+	for _, handler := range NatokServers() {
+		if handler.Conf.Addr == addr {
+			return handler
+		}
+	}
+	writeJson(w, http.StatusNotFound, map[string]string{"error": "server " + addr + " not found"})
+	return nil
+}
+
+// writeJson 输出JSON
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixClient 经由Unix域套接字请求
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestControlSocketReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() { _ = http.Serve(listener, controlMux()) }()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("control socket is accessible by other users: %v", perm)
+	}
+	// 创建套接字的临时目录已删除
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("unexpected files next to the socket: %v", entries)
+	}
+	client := unixClient(path)
+	resp, err := client.Get("http://natok-cli/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %s", resp.Status)
+	}
+	for _, req := range []struct{ method, api string }{
+		{http.MethodPost, "/api/reload"},
+		{http.MethodPost, "/api/servers/natok.test:1001/pause"},
+		{http.MethodDelete, "/api/tunnels/1"},
+	} {
+		r, _ := http.NewRequest(req.method, "http://natok-cli"+req.api, strings.NewReader(""))
+		resp, err = client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("%s %s must not be served on the control socket", req.method, req.api)
+		}
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ctl.sock")
+	live, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 有进程监听时不删除
+	if listener, err := listenUnix(path); err == nil {
+		_ = listener.Close()
+		t.Fatal("live socket was replaced")
+	}
+	// 残留的套接字文件被替换
+	_ = live.(*unixListener).UnixListener.Close()
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("stale socket was not replaced: %v", err)
+	}
+	_ = listener.Close()
+
+	// 普通文件不删除
+	file := filepath.Join(dir, "conf.yaml")
+	if err = os.WriteFile(file, []byte("natok:"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err = listenUnix(file); err == nil {
+		_ = listener.Close()
+		t.Fatal("regular file was replaced by a socket")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenUnixCloseRemoves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = listener.Close()
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left after close: %v", err)
+	}
+}
+
+func TestAdminListenLoopback(t *testing.T) {
+	cases := []struct {
+		cfg conf.AdminConf
+		ok  bool
+	}{
+		{conf.AdminConf{Addr: "127.0.0.1:0", Token: "t"}, true},
+		{conf.AdminConf{Addr: "localhost:0", Token: "t"}, true},
+		{conf.AdminConf{Addr: "127.0.0.1:0"}, false},
+		{conf.AdminConf{Addr: "0.0.0.0:0", Token: "t"}, false},
+		{conf.AdminConf{Addr: ":0", Token: "t"}, false},
+		{conf.AdminConf{Addr: "natok.test:0", Token: "t"}, false},
+		// 显式允许时监听全部网卡
+		{conf.AdminConf{Addr: "0.0.0.0:0", Token: "t", AllowRemote: true}, true},
+	}
+	for _, item := range cases {
+		listener, err := adminListen(&item.cfg)
+		if (err == nil) != item.ok {
+			t.Fatalf("%+v: %v", item.cfg, err)
+		}
+		if listener != nil {
+			_ = listener.Close()
+		}
+	}
+}
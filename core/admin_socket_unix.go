@@ -0,0 +1,34 @@
+//go:build !windows
+
+package core
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenPrivate 在仅当前用户可访问的临时目录中创建套接字，收紧权限后移至目标路径；
+// 不修改进程umask，并发创建的日志等文件不受影响
+func listenPrivate(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".natok-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// 监听地址仍为临时路径，目标路径由调用方在关闭时删除
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package core
+
+import "net"
+
+// listenPrivate Windows无Unix文件权限，套接字文件继承目录权限
+func listenPrivate(path string) (*net.UnixListener, error) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	return listener, nil
+}
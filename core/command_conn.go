@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bufio"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandConn struct 外部命令连接，经由命令的标准输入输出与natok-server通信，类似ssh的ProxyCommand
+type CommandConn struct {
+	Command string    //命令
+	cmd     *exec.Cmd //进程
+	reader  *os.File  //进程标准输出
+	writer  *os.File  //进程标准输入
+	once    sync.Once
+}
+
+// commandAddr struct 命令地址
+type commandAddr string
+
+func (a commandAddr) Network() string { return "command" }
+func (a commandAddr) String() string  { return string(a) }
+
+// DialCommand 启动外部命令，%h与%p替换为natok-server的主机与端口
+func DialCommand(command, addr string) (*CommandConn, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	command = strings.NewReplacer("%h", host, "%p", port).Replace(command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		// exec替换shell进程，结束时不遗留子进程
+		cmd = exec.Command("/bin/sh", "-c", "exec "+command)
+	}
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	for i := 0; i < 3; i++ {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, reader, writer)
+	}
+	stdinReader, stdinWriter := files[0], files[1]
+	stdoutReader, stdoutWriter := files[2], files[3]
+	stderrReader, stderrWriter := files[4], files[5]
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	if err := cmd.Start(); err != nil {
+		closeAll()
+		return nil, err
+	}
+	// 子进程持有的一端由父进程关闭
+	_ = stdinReader.Close()
+	_ = stdoutWriter.Close()
+	_ = stderrWriter.Close()
+	go func() {
+		defer func() { _ = stderrReader.Close() }()
+		scanner := bufio.NewScanner(stderrReader)
+		for scanner.Scan() {
+			log.Warnf("Command %q: %s", command, scanner.Text())
+		}
+	}()
+	c := &CommandConn{Command: command, cmd: cmd, reader: stdoutReader, writer: stdinWriter}
+	go func() {
+		err := cmd.Wait()
+		log.Debugf("Command %q exited, Error: %v", command, err)
+		// 进程退出后读取返回EOF
+		_ = c.writer.Close()
+	}()
+	return c, nil
+}
+
+func (c *CommandConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *CommandConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// Close 关闭管道并结束进程
+func (c *CommandConn) Close() error {
+	c.once.Do(func() {
+		_ = c.writer.Close()
+		_ = c.reader.Close()
+		if c.cmd.Process != nil {
+			_ = c.cmd.Process.Kill()
+		}
+	})
+	return nil
+}
+
+func (c *CommandConn) LocalAddr() net.Addr  { return commandAddr(c.Command) }
+func (c *CommandConn) RemoteAddr() net.Addr { return commandAddr(c.Command) }
+
+func (c *CommandConn) SetDeadline(t time.Time) error {
+	_ = c.writer.SetWriteDeadline(t)
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *CommandConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *CommandConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
@@ -0,0 +1,78 @@
+//go:build !windows
+
+package core
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommandConnPipe(t *testing.T) {
+	conn, err := DialCommand("cat", "natok.test:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+}
+
+func TestCommandConnPlaceholders(t *testing.T) {
+	conn, err := DialCommand("echo %h %p", "natok.test:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, err := io.ReadAll(conn)
+	if err != nil || string(out) != "natok.test 1001\n" {
+		t.Fatalf("output %q, Error: %v", out, err)
+	}
+}
+
+func TestCommandConnEarlyExit(t *testing.T) {
+	conn, err := DialCommand("true", "natok.test:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	// 进程退出后读取返回EOF
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatalf("read after exit: %d %v", n, err)
+	}
+	// 写入端随进程退出关闭
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err = conn.Write([]byte("x")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write after exit succeeded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandConnCloseKills(t *testing.T) {
+	conn, err := DialCommand("sleep 30", "natok.test:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := conn.cmd.Process
+	if err = process.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("process not running: %v", err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 进程被结束并回收
+	deadline := time.Now().Add(2 * time.Second)
+	for process.Signal(syscall.Signal(0)) != os.ErrProcessDone {
+		if time.Now().After(deadline) {
+			t.Fatal("process still running after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
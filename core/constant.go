@@ -1,6 +1,10 @@
 package core
 
-import "sync"
+import (
+	"sort"
+	"strings"
+	"sync"
+)
 
 // 数据包常量
 const (
@@ -24,9 +28,20 @@ const (
 	TypeDisabledAccessKey   = 0x08 // 禁用的访问密钥
 	TypeDisabledTrialClient = 0x09 // 禁用的试用客户端
 	TypeInvalidKey          = 0x10 // 无效的访问密钥
+	TypeFeature             = 0x11 // 特性协商
+	TypeHealthStatus        = 0x12 // 内网目标健康状态
 	HeartbeatInterval       = 10   //心跳间隔时长10秒
 )
 
+// 特性常量
+const (
+	FeatureHealth   = "health"    // 健康状态上报
+	FeatureUdpFrame = "udp-frame" // UDP数据报帧
+)
+
+// ClientFeatures 客户端支持的特性
+var ClientFeatures = []string{FeatureHealth, FeatureUdpFrame}
+
 // Counter 计数器
 type Counter struct {
 	mu    sync.Mutex
@@ -50,3 +65,37 @@ func (c *Counter) GetCount() int {
 	defer c.mu.Unlock()
 	return c.count
 }
+
+// Features 特性集合
+type Features struct {
+	mu  sync.RWMutex
+	set map[string]bool
+}
+
+func (f *Features) Set(names []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set = make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			f.set[name] = true
+		}
+	}
+}
+
+func (f *Features) Has(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.set[name]
+}
+
+func (f *Features) List() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.set))
+	for name := range f.set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,11 @@ type Message struct {
 	Data   []byte // 消息体
 }
 
+// DisconnectMessage 断开隧道的消息，沿用natok-server的约定：Uri为其下发的公网来源，Data为失败原因
+func DisconnectMessage(serial, source, reason string) Message {
+	return Message{Type: TypeDisconnect, Serial: serial, Uri: source, Data: []byte(reason)}
+}
+
 // MsgHandler interface 消息处理接口
 type MsgHandler interface {
 	Error(*ConnectHandler)                //出错
@@ -26,7 +32,9 @@ type MsgHandler interface {
 
 // ConnectHandler struct 通道链接载体
 type ConnectHandler struct {
+	mu          sync.Mutex      //写入锁，控制连接由多个协程写入
 	Name        string          //通道名称
+	BufSize     int             //读取缓冲大小，默认64kb
 	ReadTime    time.Time       //读取时间
 	WriteTime   time.Time       //写入时间
 	Active      bool            //是否活跃
@@ -38,7 +46,9 @@ type ConnectHandler struct {
 
 // Write 消息写入
 func (c *ConnectHandler) Write(msg interface{}) {
-	if c.MsgHandler == nil {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.MsgHandler == nil || c.Conn == nil {
 		return
 	}
 	data := c.MsgHandler.Encode(msg)
@@ -46,6 +56,22 @@ func (c *ConnectHandler) Write(msg interface{}) {
 	_, _ = c.Conn.Write(data)
 }
 
+// SetConn 更换连接通道
+func (c *ConnectHandler) SetConn(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn = conn
+}
+
+// CloseConn 关闭连接通道
+func (c *ConnectHandler) CloseConn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Conn != nil {
+		_ = c.Conn.Close()
+	}
+}
+
 // Listen 连接请求监听
 func (c *ConnectHandler) Listen() {
 	defer func() {
@@ -70,8 +96,12 @@ func (c *ConnectHandler) Listen() {
 			_ = c.Conn.Close()
 		}
 
-		// 最大包64kb
-		buf := make([]byte, 1024*64)
+		// 最大包默认64kb
+		size := c.BufSize
+		if size <= 0 {
+			size = 1024 * 64
+		}
+		buf := make([]byte, size)
 		n, err := c.Conn.Read(buf)
 		if err != nil || n == 0 {
 			log.Errorf("Error: %+v", err)
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 域名解析器与静态解析，重新加载配置时整体替换
+var (
+	dnsMu       sync.RWMutex
+	resolver    = net.DefaultResolver
+	staticHosts = make(map[string][]net.IP)
+)
+
+// InitResolver 初始化域名解析：静态解析优先，其次为自定义DNS服务器，未配置时使用系统解析
+func InitResolver(cfg *conf.DnsConf) {
+	hosts, dns := make(map[string][]net.IP), net.DefaultResolver
+	defer func() {
+		dnsMu.Lock()
+		staticHosts, resolver = hosts, dns
+		dnsMu.Unlock()
+	}()
+	if cfg == nil {
+		return
+	}
+	for name, value := range cfg.Hosts {
+		var ips []net.IP
+		for _, item := range strings.Split(value, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(item)); ip != nil {
+				ips = append(ips, ip)
+			} else {
+				log.Warnf("Dns static host %s has invalid address %q", name, item)
+			}
+		}
+		if len(ips) > 0 {
+			hosts[strings.ToLower(strings.TrimSuffix(name, "."))] = ips
+		}
+	}
+	if len(cfg.Nameservers) == 0 {
+		return
+	}
+	var servers []string
+	for _, server := range cfg.Nameservers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		servers = append(servers, server)
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var next uint32
+	dns = &net.Resolver{
+		PreferGo: true,
+		// 忽略系统配置的DNS服务器，轮流使用自定义服务器
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1))%len(servers)]
+			if cfg.Tcp {
+				network = "tcp"
+			}
+			dialer := net.Dialer{Timeout: timeout}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	log.Infof("Dns nameservers: %v, Tcp: %v", servers, cfg.Tcp)
+}
+
+// LookupIP 解析主机地址
+func LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	dnsMu.RLock()
+	ips, ok := staticHosts[strings.ToLower(strings.TrimSuffix(host, "."))]
+	dns := resolver
+	dnsMu.RUnlock()
+	if ok {
+		return ips, nil
+	}
+	addrs, err := dns.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	ips = make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
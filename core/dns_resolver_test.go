@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsAnswer 应答DNS查询：A记录返回ip，其余类型无记录
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	resp := append([]byte(nil), query[:12]...)
+	// 应答、递归可用，仅保留问题
+	resp[2], resp[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	resp = append(resp, query[12:end]...)
+	if binary.BigEndian.Uint16(query[end-4:]) == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+// dnsStandIn 本地UDP DNS服务，A记录均解析为ip，返回地址与查询计数
+func dnsStandIn(t *testing.T, ip string) (string, *int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	queries := new(int32)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			if resp := dnsAnswer(buf[:n], net.ParseIP(ip)); resp != nil {
+				_, _ = conn.WriteTo(resp, peer)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+// dnsTcpStandIn 本地TCP DNS服务，消息带2字节长度前缀
+func dnsTcpStandIn(t *testing.T, ip string) (string, *int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	queries := new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				for {
+					size := make([]byte, 2)
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(size))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					atomic.AddInt32(queries, 1)
+					resp := dnsAnswer(query, net.ParseIP(ip))
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), queries
+}
+
+// lookup 经由当前解析配置查询主机地址
+func lookup(t *testing.T, host string) []net.IP {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ips, err := LookupIP(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ips
+}
+
+func TestResolverStaticHosts(t *testing.T) {
+	server, queries := dnsStandIn(t, "192.0.2.1")
+	InitResolver(&conf.DnsConf{Nameservers: []string{server}, Hosts: map[string]string{"App.Natok.Test": "198.51.100.1, 2001:db8::1,invalid"}})
+	defer InitResolver(nil)
+	// 静态解析优先，忽略大小写与末尾的点，无效地址被忽略
+	for _, host := range []string{"app.natok.test", "APP.natok.test."} {
+		if ips := lookup(t, host); len(ips) != 2 || ips[0].String() != "198.51.100.1" || ips[1].String() != "2001:db8::1" {
+			t.Fatalf("%s -> %v", host, ips)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 0 {
+		t.Fatalf("static host queried nameserver %d times", n)
+	}
+	// 其余域名经由DNS服务器解析
+	if ips := lookup(t, "other.natok.test."); len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Fatalf("other.natok.test -> %v", ips)
+	}
+}
+
+func TestResolverRoundRobin(t *testing.T) {
+	first, firstQueries := dnsStandIn(t, "192.0.2.1")
+	second, secondQueries := dnsStandIn(t, "192.0.2.2")
+	InitResolver(&conf.DnsConf{Nameservers: []string{first, second}})
+	defer InitResolver(nil)
+	for i := 0; i < 4; i++ {
+		if ips := lookup(t, "app.natok.test."); len(ips) != 1 {
+			t.Fatalf("app.natok.test -> %v", ips)
+		}
+	}
+	// 每次查询轮流使用服务器，A与AAAA查询分别计数
+	a, b := atomic.LoadInt32(firstQueries), atomic.LoadInt32(secondQueries)
+	if a == 0 || b == 0 || a+b < 8 || a-b > 1 || b-a > 1 {
+		t.Fatalf("queries not balanced: %d %d", a, b)
+	}
+}
+
+func TestResolverTcp(t *testing.T) {
+	server, queries := dnsTcpStandIn(t, "192.0.2.3")
+	// 该端口仅监听TCP，经由UDP查询时失败
+	InitResolver(&conf.DnsConf{Nameservers: []string{server}, Tcp: true, Timeout: 2})
+	defer InitResolver(nil)
+	if ips := lookup(t, "app.natok.test."); len(ips) != 1 || ips[0].String() != "192.0.2.3" {
+		t.Fatalf("app.natok.test -> %v", ips)
+	}
+	if atomic.LoadInt32(queries) == 0 {
+		t.Fatal("no tcp query received")
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthState struct 健康状态
+type HealthState struct {
+	Target  string    `json:"target"`  //内网目标
+	Backend string    `json:"backend"` //后端地址
+	Healthy bool      `json:"healthy"` //是否健康
+	Checked time.Time `json:"checked"` //检查时间
+	Error   string    `json:"error"`   //最近错误
+}
+
+var (
+	natokMu       sync.Mutex
+	natokHandlers []*NatokHandler //已注册的natok-server
+)
+
+// RegisterNatok 注册natok-server句柄，用于状态上报
+func RegisterNatok(handler *NatokHandler) {
+	natokMu.Lock()
+	defer natokMu.Unlock()
+	natokHandlers = append(natokHandlers, handler)
+}
+
+// HealthCheck 周期性检查后端健康状态
+func (t *TargetHandler) HealthCheck(backend *Backend) {
+	hc := t.Conf.HealthCheck
+	interval := time.Duration(hc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		err := t.check(backend.Addr)
+		if changed := backend.update(err, hc.Rise, hc.Fall); changed {
+			state := t.state(backend)
+			if state.Healthy {
+				log.Infof("Intranet backend %s -> %s is healthy", state.Target, state.Backend)
+			} else {
+				log.Warnf("Intranet backend %s -> %s is unhealthy, Error: %s", state.Target, state.Backend, state.Error)
+			}
+			ReportHealth(state)
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// check 执行一次健康检查，与转发流量相同经由上游代理与TLS连接；PROXY协议头不携带来源地址
+func (t *TargetHandler) check(addr string) error {
+	hc := t.Conf.HealthCheck
+	timeout := time.Duration(hc.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	conn, err := t.dial("tcp", addr, "", timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	switch hc.Type {
+	case "http":
+		path := hc.Path
+		if path == "" {
+			path = "/"
+		}
+		host := addr
+		if strings.HasPrefix(addr, "unix://") {
+			host = "localhost"
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		req.Header.Set("User-Agent", "natok-cli")
+		req.Close = true
+		if err = req.Write(conn); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		code := strconv.Itoa(resp.StatusCode)
+		if hc.Expect != "" && !strings.HasPrefix(code, hc.Expect) {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if hc.Expect == "" && resp.StatusCode >= 500 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	case "payload":
+		if hc.Send != "" {
+			if _, err = conn.Write([]byte(hc.Send)); err != nil {
+				return err
+			}
+		}
+		if hc.Expect != "" {
+			buf := make([]byte, len(hc.Expect))
+			if _, err = io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			if !bytes.Equal([]byte(hc.Expect), buf) {
+				return fmt.Errorf("unexpected payload %q", buf)
+			}
+		}
+	}
+	return nil
+}
+
+// update 更新检查结果，返回健康状态是否变化
+func (b *Backend) update(err error, rise, fall int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rise <= 0 {
+		rise = 1
+	}
+	if fall <= 0 {
+		fall = 1
+	}
+	b.checked = time.Now()
+	if err == nil {
+		b.err = ""
+		b.fall = 0
+		b.rise++
+		if !b.healthy && b.rise >= rise {
+			b.healthy = true
+			return true
+		}
+		return false
+	}
+	b.err = err.Error()
+	b.rise = 0
+	b.fall++
+	if b.healthy && b.fall >= fall {
+		b.healthy = false
+		return true
+	}
+	return false
+}
+
+// state 获取后端健康状态
+func (t *TargetHandler) state(backend *Backend) HealthState {
+	backend.mu.RLock()
+	defer backend.mu.RUnlock()
+	return HealthState{
+		Target:  t.Conf.Addr,
+		Backend: backend.Addr,
+		Healthy: backend.healthy,
+		Checked: backend.checked,
+		Error:   backend.err,
+	}
+}
+
+// HealthStatus 获取全部后端健康状态
+func HealthStatus() []HealthState {
+	list := make([]HealthState, 0)
+	for _, target := range Targets() {
+		for _, backend := range target.Backends {
+			list = append(list, target.state(backend))
+		}
+	}
+	return list
+}
+
+// ReportHealth 向支持的natok-server上报健康状态
+func ReportHealth(states ...HealthState) {
+	natokMu.Lock()
+	handlers := append([]*NatokHandler(nil), natokHandlers...)
+	natokMu.Unlock()
+	for _, handler := range handlers {
+		handler.ReportHealth(states...)
+	}
+}
+
+// ReportHealth 向natok-server上报健康状态
+func (p *NatokHandler) ReportHealth(states ...HealthState) {
+	if p.Main == nil || !p.Features.Has(FeatureHealth) {
+		return
+	}
+	for _, state := range states {
+		data, _ := json.Marshal(state)
+		p.Main.Write(Message{Type: TypeHealthStatus, Uri: p.AccessKey, Data: data})
+	}
+}
+
+// HealthServe 本地健康状态查询
+func HealthServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(HealthStatus())
+	})
+	log.Infof("Health status listen: http://%s/health", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Health status listen failed, Addr: %s, Error: %+v", addr, err)
+	}
+}
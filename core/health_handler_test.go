@@ -0,0 +1,137 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBackendRiseFall(t *testing.T) {
+	backend := &Backend{Addr: "127.0.0.1:1", healthy: true}
+	failed := errors.New("connection refused")
+	steps := []struct {
+		err     error
+		changed bool
+		healthy bool
+	}{
+		{failed, false, true},
+		{nil, false, true},
+		{failed, false, true},
+		{failed, true, false},
+		{failed, false, false},
+		{nil, false, false},
+		{nil, true, true},
+	}
+	for i, step := range steps {
+		if changed := backend.update(step.err, 2, 2); changed != step.changed || backend.Healthy() != step.healthy {
+			t.Fatalf("step %d: changed %v healthy %v, want %v %v", i, changed, backend.Healthy(), step.changed, step.healthy)
+		}
+	}
+}
+
+func TestHealthCheckHttp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			w.WriteHeader(http.StatusMovedPermanently)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	cases := []struct {
+		path, expect string
+		ok           bool
+	}{
+		{"/ok", "", true},
+		{"/down", "", false},
+		{"/moved", "", true},
+		{"/moved", "2", false},
+		{"/ok", "200", true},
+	}
+	for _, item := range cases {
+		target := &TargetHandler{Conf: conf.Target{Addr: addr, HealthCheck: &conf.HealthCheck{Type: "http", Path: item.path, Expect: item.expect, Timeout: 1}}}
+		if err := target.check(addr); (err == nil) != item.ok {
+			t.Fatalf("check %s expect %q: %v", item.path, item.expect, err)
+		}
+	}
+}
+
+func TestHealthCheckPayload(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err == nil && string(buf) == "PING" {
+					_, _ = conn.Write([]byte("PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	for _, item := range []struct {
+		expect string
+		ok     bool
+	}{{"PONG", true}, {"PANG", false}} {
+		target := &TargetHandler{Conf: conf.Target{Addr: addr, HealthCheck: &conf.HealthCheck{Type: "payload", Send: "PING", Expect: item.expect, Timeout: 1}}}
+		if err := target.check(addr); (err == nil) != item.ok {
+			t.Fatalf("expect %q: %v", item.expect, err)
+		}
+	}
+}
+
+func TestHealthCheckViaProxy(t *testing.T) {
+	echo := echoServer(t)
+	proxy, targets := proxyStandIn(t, socks5Handshake)
+	dialer, err := NewProxyDialer("socks5://user:pass@"+proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 仅能经由上游代理访问的后端，健康检查同样经由代理
+	target := &TargetHandler{Proxy: dialer, Conf: conf.Target{Addr: echo, HealthCheck: &conf.HealthCheck{Type: "payload", Send: "hi", Expect: "hi", Timeout: 1}}}
+	if err = target.check(echo); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-targets; got != echo {
+		t.Fatalf("check did not go through the proxy: %s", got)
+	}
+}
+
+func TestPickSkipsUnhealthy(t *testing.T) {
+	target := &TargetHandler{Conf: conf.Target{Addr: "app"}, Backends: []*Backend{
+		{Addr: "a", healthy: true}, {Addr: "b"}, {Addr: "c", healthy: true},
+	}}
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		addr, err := target.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addr]++
+	}
+	if seen["b"] != 0 || seen["a"] == 0 || seen["c"] == 0 {
+		t.Fatalf("unexpected selection: %v", seen)
+	}
+	target.Backends[0].healthy, target.Backends[2].healthy = false, false
+	if _, err := target.Pick(); err == nil {
+		t.Fatal("expected no healthy backend error")
+	}
+}
@@ -0,0 +1,291 @@
+package core
+
+import (
+	"bufio"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HttpConn struct HTTP感知的内网连接，改写经由隧道发往内网服务的请求头
+type HttpConn struct {
+	net.Conn                                     //内网连接
+	Conf     *conf.HttpConf                      //配置
+	Host     string                              //改写的Host
+	Source   string                              //公网来源地址
+	Dial     func(addr string) (net.Conn, error) //路由后端连接
+	Log      *log.Entry                          //隧道日志
+	pw       *io.PipeWriter                      //隧道数据写入
+	pr       *io.PipeReader                      //隧道数据读取
+	rw       *io.PipeWriter                      //路由响应写入
+	rr       *io.PipeReader                      //路由响应读取
+	mu       sync.Mutex
+	backends map[string]*httpBackend //路由后端连接
+}
+
+// httpBackend struct 路由后端连接
+type httpBackend struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewHttpConn 创建HTTP感知的内网连接，配置路由时按Host或路径前缀选择本地服务
+func NewHttpConn(conn net.Conn, cfg *conf.HttpConf, host, source string, dial func(string) (net.Conn, error), logger *log.Entry) *HttpConn {
+	pr, pw := io.Pipe()
+	c := &HttpConn{Conn: conn, Conf: cfg, Host: host, Source: source, Dial: dial, Log: logger, pr: pr, pw: pw}
+	if logger == nil {
+		c.Log = log.NewEntry(log.StandardLogger())
+	}
+	if cfg.Host != "" {
+		c.Host = cfg.Host
+	}
+	if len(cfg.Routes) > 0 {
+		c.rr, c.rw = io.Pipe()
+		c.backends = make(map[string]*httpBackend)
+		go c.route()
+	} else {
+		go c.serve()
+	}
+	return c
+}
+
+// Read 读取发往隧道的数据
+func (c *HttpConn) Read(b []byte) (int, error) {
+	if c.rr != nil {
+		return c.rr.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write 写入来自隧道的数据
+func (c *HttpConn) Write(b []byte) (int, error) {
+	return c.pw.Write(b)
+}
+
+// Close 关闭连接
+func (c *HttpConn) Close() error {
+	_ = c.pw.Close()
+	if c.rw != nil {
+		_ = c.rw.Close()
+		c.mu.Lock()
+		for addr, backend := range c.backends {
+			_ = backend.conn.Close()
+			delete(c.backends, addr)
+		}
+		c.mu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// serve 逐个解析请求，改写请求头后转发至内网服务
+func (c *HttpConn) serve() {
+	reader := bufio.NewReader(c.pr)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				c.Log.Warnf("Read http request failed, Target: %s, Error: %+v", c.Host, err)
+			}
+			_ = c.Close()
+			return
+		}
+		c.Rewrite(req, c.Host)
+		err = req.Write(c.Conn)
+		_ = req.Body.Close()
+		if err != nil {
+			c.Log.Warnf("Write http request failed, Target: %s, Error: %+v", c.Host, err)
+			_ = c.Close()
+			return
+		}
+		// 协议升级后按原始数据转发
+		if req.Header.Get("Upgrade") != "" {
+			_, _ = io.Copy(c.Conn, reader)
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// route 逐个解析请求并路由至本地服务，按序转发响应以保持长连接语义
+func (c *HttpConn) route() {
+	defer func() { _ = c.Close() }()
+	reader := bufio.NewReader(c.pr)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				c.Log.Warnf("Read http request failed, Target: %s, Error: %+v", c.Host, err)
+			}
+			return
+		}
+		addr, host := c.Match(req)
+		backend, reused, err := c.backend(addr)
+		if err != nil {
+			c.Log.Warnf("Connect http route failed, Route: %s%s -> %s, Error: %+v", req.Host, req.URL.Path, addr, err)
+			c.badGateway(req)
+			return
+		}
+		c.Log.Debugf("Http route %s%s -> %s", req.Host, req.URL.Path, addr)
+		c.Rewrite(req, host)
+		err = send(backend, req)
+		// 复用的后端连接可能已被本地服务关闭，未收到响应时丢弃，可重放的请求重新连接一次
+		if err != nil && addr != "" {
+			c.drop(addr)
+			if reused && replayable(req) {
+				c.Log.Debugf("Http route %s stale, redial, Error: %v", addr, err)
+				if backend, _, err = c.backend(addr); err == nil {
+					err = send(backend, req)
+				}
+			}
+		}
+		_ = req.Body.Close()
+		if err != nil {
+			c.Log.Warnf("Write http request failed, Target: %s, Error: %+v", addr, err)
+			c.drop(addr)
+			c.badGateway(req)
+			return
+		}
+		resp, err := http.ReadResponse(backend.reader, req)
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if err = resp.Write(c.rw); err == nil {
+				resp, err = http.ReadResponse(backend.reader, req)
+			}
+		}
+		if err != nil {
+			c.Log.Warnf("Read http response failed, Target: %s, Error: %+v", addr, err)
+			return
+		}
+		err = resp.Write(c.rw)
+		_ = resp.Body.Close()
+		if err != nil {
+			return
+		}
+		// 协议升级后按原始数据双向转发
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			go func() { _, _ = io.Copy(c.rw, backend.reader) }()
+			_, _ = io.Copy(backend.conn, reader)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// Match 匹配路由，返回本地服务地址与改写的Host
+func (c *HttpConn) Match(req *http.Request) (string, string) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range c.Conf.Routes {
+		if route.Host != "" && !matchHost(strings.ToLower(route.Host), host) {
+			continue
+		}
+		if route.Path != "" && !strings.HasPrefix(req.URL.Path, route.Path) {
+			continue
+		}
+		if route.RewriteHost != "" {
+			return route.Addr, route.RewriteHost
+		}
+		return route.Addr, route.Addr
+	}
+	return "", c.Host
+}
+
+// matchHost 匹配Host，支持*.example.com形式的通配
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// backend 获取路由后端连接，空地址为默认内网连接，reused为是否复用已有连接
+func (c *HttpConn) backend(addr string) (*httpBackend, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if backend, ok := c.backends[addr]; ok {
+		return backend, true, nil
+	}
+	conn := c.Conn
+	if addr != "" {
+		var err error
+		if conn, err = c.Dial(addr); err != nil {
+			return nil, false, err
+		}
+	}
+	backend := &httpBackend{conn: conn, reader: bufio.NewReader(conn)}
+	c.backends[addr] = backend
+	return backend, false, nil
+}
+
+// drop 关闭并丢弃路由后端连接，默认内网连接不丢弃
+func (c *HttpConn) drop(addr string) {
+	if addr == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if backend, ok := c.backends[addr]; ok {
+		_ = backend.conn.Close()
+		delete(c.backends, addr)
+	}
+}
+
+// badGateway 响应502并结束连接
+func (c *HttpConn) badGateway(req *http.Request) {
+	_ = req.Body.Close()
+	resp := &http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1, Request: req, Close: true}
+	_ = resp.Write(c.rw)
+}
+
+// send 发送请求并等待响应的首个字节，未收到任何响应即失败
+func send(backend *httpBackend, req *http.Request) error {
+	if err := req.Write(backend.conn); err != nil {
+		return err
+	}
+	_, err := backend.reader.Peek(1)
+	return err
+}
+
+// replayable 请求幂等且无请求体，可在新连接上重放
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// Rewrite 改写请求头
+func (c *HttpConn) Rewrite(req *http.Request, host string) {
+	req.Host = host
+	if ip, _, ok := ParseSource(c.Source); ok {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+ip.String())
+		} else {
+			req.Header.Set("X-Forwarded-For", ip.String())
+		}
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+	proto := c.Conf.Proto
+	if proto == "" {
+		proto = "http"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	for _, name := range c.Conf.RemoveHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range c.Conf.SetHeaders {
+		req.Header.Set(name, value)
+	}
+	// 不附加默认的User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+}
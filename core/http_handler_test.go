@@ -0,0 +1,201 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// httpRewrite 经由HttpConn转发一个请求，返回内网服务收到的请求
+func httpRewrite(t *testing.T, cfg *conf.HttpConf, raw string) *http.Request {
+	t.Helper()
+	backend, local := net.Pipe()
+	conn := NewHttpConn(local, cfg, "127.0.0.1:8080", "203.0.113.7:5000", nil, nil)
+	t.Cleanup(func() { _ = conn.Close(); _ = backend.Close() })
+	go func() { _, _ = conn.Write([]byte(raw)) }()
+	_ = backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestHttpRewriteForwardedHeaders(t *testing.T) {
+	req := httpRewrite(t, &conf.HttpConf{}, "GET /index HTTP/1.1\r\nHost: demo.natok.cn\r\nX-Forwarded-For: 198.51.100.1\r\n\r\n")
+	if req.Host != "127.0.0.1:8080" {
+		t.Fatalf("host not rewritten: %s", req.Host)
+	}
+	if got := req.Header.Get("X-Forwarded-For"); got != "198.51.100.1, 203.0.113.7" {
+		t.Fatalf("X-Forwarded-For: %q", got)
+	}
+	if got := req.Header.Get("X-Real-IP"); got != "203.0.113.7" {
+		t.Fatalf("X-Real-IP: %q", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Proto"); got != "http" {
+		t.Fatalf("X-Forwarded-Proto: %q", got)
+	}
+	if _, ok := req.Header["User-Agent"]; ok {
+		t.Fatalf("default user agent added: %q", req.Header.Get("User-Agent"))
+	}
+}
+
+func TestHttpRewriteHeaderRules(t *testing.T) {
+	cfg := &conf.HttpConf{
+		Host:          "app.internal",
+		Proto:         "https",
+		SetHeaders:    map[string]string{"X-Tenant": "natok", "Cookie": "fixed=1"},
+		RemoveHeaders: []string{"Authorization", "X-Real-IP"},
+	}
+	req := httpRewrite(t, cfg, "POST /api HTTP/1.1\r\nHost: demo.natok.cn\r\nAuthorization: Bearer x\r\nCookie: a=b\r\nUser-Agent: curl\r\nContent-Length: 2\r\n\r\nok")
+	if req.Host != "app.internal" || req.Header.Get("X-Forwarded-Proto") != "https" {
+		t.Fatalf("unexpected host or proto: %s %s", req.Host, req.Header.Get("X-Forwarded-Proto"))
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("X-Real-IP") != "" {
+		t.Fatalf("removed headers still present: %v", req.Header)
+	}
+	if req.Header.Get("X-Tenant") != "natok" || req.Header.Get("Cookie") != "fixed=1" || req.Header.Get("User-Agent") != "curl" {
+		t.Fatalf("set headers not applied: %v", req.Header)
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "ok" {
+		t.Fatalf("body: %q", body)
+	}
+}
+
+func TestHttpRewriteKeepAlive(t *testing.T) {
+	backend, local := net.Pipe()
+	conn := NewHttpConn(local, &conf.HttpConf{}, "127.0.0.1:8080", "203.0.113.7:5000", nil, nil)
+	defer func() { _ = conn.Close(); _ = backend.Close() }()
+	go func() {
+		_, _ = conn.Write([]byte("GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: y\r\n\r\n"))
+	}()
+	_ = backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(backend)
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.Path != path || req.Host != "127.0.0.1:8080" || req.Header.Get("X-Real-IP") != "203.0.113.7" {
+			t.Fatalf("request %s not rewritten: %s %s %v", path, req.URL.Path, req.Host, req.Header)
+		}
+	}
+}
+
+func TestHttpRouteMatch(t *testing.T) {
+	c := &HttpConn{Host: "127.0.0.1:8080", Conf: &conf.HttpConf{Routes: []conf.HttpRoute{
+		{Host: "api.natok.cn", Path: "/v2", Addr: "127.0.0.1:9002"},
+		{Host: "api.natok.cn", Addr: "127.0.0.1:9001"},
+		{Host: "*.natok.cn", Path: "/static", Addr: "127.0.0.1:9003", RewriteHost: "static.local"},
+		{Path: "/health", Addr: "127.0.0.1:9004"},
+	}}}
+	cases := []struct {
+		host, path, addr, rewrite string
+	}{
+		{"api.natok.cn", "/v2/users", "127.0.0.1:9002", "127.0.0.1:9002"},
+		{"API.natok.cn:443", "/v1/users", "127.0.0.1:9001", "127.0.0.1:9001"},
+		{"api.natok.cn", "/static/a.js", "127.0.0.1:9001", "127.0.0.1:9001"},
+		{"www.natok.cn", "/static/a.js", "127.0.0.1:9003", "static.local"},
+		{"natok.cn", "/static/a.js", "", "127.0.0.1:8080"},
+		{"other.cn", "/health", "127.0.0.1:9004", "127.0.0.1:9004"},
+		{"other.cn", "/", "", "127.0.0.1:8080"},
+	}
+	for _, item := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+item.host+item.path, nil)
+		if addr, rewrite := c.Match(req); addr != item.addr || rewrite != item.rewrite {
+			t.Fatalf("%s%s -> %s %s, want %s %s", item.host, item.path, addr, rewrite, item.addr, item.rewrite)
+		}
+	}
+}
+
+// httpRoute 按路由转发至addr的HttpConn，默认内网连接不使用
+func httpRoute(t *testing.T, addr string) (*HttpConn, *bufio.Reader) {
+	t.Helper()
+	idle, local := net.Pipe()
+	cfg := &conf.HttpConf{Routes: []conf.HttpRoute{{Path: "/", Addr: addr}}}
+	conn := NewHttpConn(local, cfg, "127.0.0.1:8080", "203.0.113.7:5000", func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}, nil)
+	t.Cleanup(func() { _ = conn.Close(); _ = idle.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// httpExchange 经由HttpConn发送请求并读取响应
+func httpExchange(t *testing.T, conn *HttpConn, reader *bufio.Reader, raw string) *http.Response {
+	t.Helper()
+	go func() { _, _ = conn.Write([]byte(raw)) }()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp
+}
+
+func TestHttpRouteUpgrade(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	go func() {
+		backend := <-accepted
+		defer func() { _ = backend.Close() }()
+		reader := bufio.NewReader(backend)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		_, _ = backend.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		_, _ = io.Copy(backend, reader)
+	}()
+	conn, reader := httpRoute(t, addr)
+	resp := httpExchange(t, conn, reader, "GET /ws HTTP/1.1\r\nHost: demo.natok.cn\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// 升级后按原始数据双向转发
+	go func() { _, _ = conn.Write([]byte("raw frame")) }()
+	buf := make([]byte, len("raw frame"))
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "raw frame" {
+		t.Fatalf("raw data %q, Error: %v", buf, err)
+	}
+}
+
+func TestHttpRouteStaleBackend(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	count := make(chan int, 8)
+	go func() {
+		n := 0
+		for backend := range accepted {
+			n++
+			count <- n
+			// 每个连接仅响应一个请求后关闭，不告知Connection: close
+			go func(backend net.Conn) {
+				defer func() { _ = backend.Close() }()
+				reader := bufio.NewReader(backend)
+				if _, err := http.ReadRequest(reader); err == nil {
+					_, _ = backend.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+			}(backend)
+		}
+	}()
+	conn, reader := httpRoute(t, addr)
+	for i := 0; i < 2; i++ {
+		if resp := httpExchange(t, conn, reader, "GET / HTTP/1.1\r\nHost: demo.natok.cn\r\n\r\n"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d status %d", i, resp.StatusCode)
+		}
+		<-count
+		// 等待后端关闭连接
+		time.Sleep(50 * time.Millisecond)
+	}
+	// 不可重放的请求不重新连接
+	if resp := httpExchange(t, conn, reader, "POST / HTTP/1.1\r\nHost: demo.natok.cn\r\nContent-Length: 2\r\n\r\nok"); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("post on stale backend status %d", resp.StatusCode)
+	}
+	select {
+	case n := <-count:
+		t.Fatalf("post redialed, connections %d", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,11 +1,10 @@
 package core
 
-import log "github.com/sirupsen/logrus"
-
 // IntraServerHandler struct 内网服务处理
 type IntraServerHandler struct {
 	Uri            string
 	AccessKey      string
+	Tunnel         *Tunnel //隧道
 	NatokHandler   *NatokHandler
 	connectHandler *ConnectHandler
 }
@@ -28,21 +27,20 @@ func (s *IntraServerHandler) Receive(connHandler *ConnectHandler, data interface
 	if conn := connHandler.ConnHandler; conn != nil {
 		msg := Message{Type: TypeTransfer, Data: data.([]byte)}
 		conn.Write(msg)
-		log.Debugf("intra receive message %s", connHandler.Name)
+		s.Tunnel.Out(len(msg.Data))
+		s.Tunnel.Logger().Debugf("intra receive message %s", connHandler.Name)
 	}
 }
 
 // Error 错误处理
 func (s *IntraServerHandler) Error(connHandler *ConnectHandler) {
 	if natokHandler := connHandler.ConnHandler; natokHandler != nil {
-		msg := Message{Type: TypeDisconnect, Uri: s.Uri}
-		natokHandler.Write(msg)
+		natokHandler.Write(DisconnectMessage(s.Tunnel.Serial, s.Uri, ""))
 		connHandler.ConnHandler = nil
 	}
 }
 
 // Failure 失败处理
 func (s *IntraServerHandler) Failure() {
-	msg := Message{Type: TypeDisconnect, Uri: s.Uri}
-	s.connectHandler.Write(msg)
+	s.connectHandler.Write(DisconnectMessage(s.Tunnel.Serial, s.Uri, ""))
 }
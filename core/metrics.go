@@ -0,0 +1,202 @@
+package core
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 监控指标
+const (
+	MetricServerConnected = "natok_server_connected"
+	MetricReconnects      = "natok_server_reconnects_total"
+	MetricAuthResults     = "natok_auth_results_total"
+	MetricHeartbeatRtt    = "natok_heartbeat_rtt_seconds"
+	MetricTunnelsActive   = "natok_tunnels_active"
+	MetricTunnelsOpened   = "natok_tunnels_opened_total"
+	MetricTunnelsClosed   = "natok_tunnels_closed_total"
+	MetricTunnelsFailed   = "natok_tunnels_failed_total"
+	MetricBytes           = "natok_bytes_total"
+	MetricDialSeconds     = "natok_intra_dial_seconds"
+	MetricUdpDropped      = "natok_udp_dropped_total"
+)
+
+// 指标类型与说明
+var metricDesc = map[string][2]string{
+	MetricServerConnected: {"gauge", "Whether the control connection to natok-server is established."},
+	MetricReconnects:      {"counter", "Reconnects of the control connection to natok-server."},
+	MetricAuthResults:     {"counter", "Authentication outcomes of the control connection, success or the failure message type."},
+	MetricHeartbeatRtt:    {"gauge", "Round trip time of the last heartbeat answered by natok-server."},
+	MetricTunnelsActive:   {"gauge", "Tunnels currently open."},
+	MetricTunnelsOpened:   {"counter", "Tunnels opened to intranet targets."},
+	MetricTunnelsClosed:   {"counter", "Tunnels closed."},
+	MetricTunnelsFailed:   {"counter", "Tunnels that failed to connect the intranet target, by reason."},
+	MetricBytes:           {"counter", "Bytes transferred per intranet target; in is toward the target, out is toward natok-server."},
+	MetricDialSeconds:     {"histogram", "Latency of intranet target dials."},
+	MetricUdpDropped:      {"counter", "Udp datagrams dropped for exceeding max-datagram-size; in is toward the target, out is toward natok-server."},
+}
+
+// 直方图分桶（秒）
+var dialBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricSet struct 指标集合，按指标名称与标签保存数值
+type MetricSet struct {
+	mu     sync.Mutex
+	values map[string]map[string]float64 //指标名称 -> 标签 -> 数值
+}
+
+// Metrics 全局指标
+var Metrics = &MetricSet{values: make(map[string]map[string]float64)}
+
+// labels 标签序列化，参数为键值对
+func labels(pairs ...string) string {
+	var items []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		items = append(items, pairs[i]+`="`+value+`"`)
+	}
+	return strings.Join(items, ",")
+}
+
+// update 更新指标
+func (m *MetricSet) update(name, label string, fn func(float64) float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+	series[label] = fn(series[label])
+}
+
+// Add 计数增加
+func (m *MetricSet) Add(name string, value float64, pairs ...string) {
+	m.update(name, labels(pairs...), func(old float64) float64 { return old + value })
+}
+
+// Set 设置数值
+func (m *MetricSet) Set(name string, value float64, pairs ...string) {
+	m.update(name, labels(pairs...), func(float64) float64 { return value })
+}
+
+// Observe 记录直方图样本
+func (m *MetricSet) Observe(name string, value float64, pairs ...string) {
+	label := labels(pairs...)
+	sep := ""
+	if label != "" {
+		sep = ","
+	}
+	for _, bucket := range dialBuckets {
+		hit := 0.0
+		if value <= bucket {
+			hit = 1
+		}
+		le := label + sep + `le="` + strconv.FormatFloat(bucket, 'g', -1, 64) + `"`
+		m.update(name+"_bucket", le, func(old float64) float64 { return old + hit })
+	}
+	m.update(name+"_bucket", label+sep+`le="+Inf"`, func(old float64) float64 { return old + 1 })
+	m.update(name+"_sum", label, func(old float64) float64 { return old + value })
+	m.update(name+"_count", label, func(old float64) float64 { return old + 1 })
+}
+
+// WriteTo 以Prometheus文本格式输出
+func (m *MetricSet) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sb strings.Builder
+	names := make([]string, 0, len(metricDesc))
+	for name := range metricDesc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		desc := metricDesc[name]
+		_, _ = fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, desc[1], name, desc[0])
+		series := []string{name}
+		if desc[0] == "histogram" {
+			series = []string{name + "_bucket", name + "_sum", name + "_count"}
+		}
+		for _, item := range series {
+			keys := make([]string, 0, len(m.values[item]))
+			for label := range m.values[item] {
+				keys = append(keys, label)
+			}
+			if item == name+"_bucket" {
+				sort.Slice(keys, func(i, j int) bool { return bucketLess(keys[i], keys[j]) })
+			} else {
+				sort.Strings(keys)
+			}
+			for _, label := range keys {
+				value := strconv.FormatFloat(m.values[item][label], 'g', -1, 64)
+				if label == "" {
+					_, _ = fmt.Fprintf(&sb, "%s %s\n", item, value)
+				} else {
+					_, _ = fmt.Fprintf(&sb, "%s{%s} %s\n", item, label, value)
+				}
+			}
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// bucketLess 分桶排序：相同标签的分桶按le数值升序，+Inf在最后
+func bucketLess(a, b string) bool {
+	const key = `le="`
+	ai, bi := strings.LastIndex(a, key), strings.LastIndex(b, key)
+	if ai < 0 || bi < 0 || a[:ai] != b[:bi] {
+		return a < b
+	}
+	bound := func(label string) float64 {
+		value, err := strconv.ParseFloat(strings.TrimSuffix(label, `"`), 64)
+		if err != nil {
+			return math.Inf(1)
+		}
+		return value
+	}
+	return bound(a[ai+len(key):]) < bound(b[bi+len(key):])
+}
+
+// TunnelOpened 隧道已打开
+func TunnelOpened(server, target string) {
+	Metrics.Add(MetricTunnelsOpened, 1, "server", server, "target", target)
+	Metrics.Add(MetricTunnelsActive, 1, "server", server)
+}
+
+// TunnelClosed 隧道已关闭
+func TunnelClosed(server, target string) {
+	Metrics.Add(MetricTunnelsClosed, 1, "server", server, "target", target)
+	Metrics.Add(MetricTunnelsActive, -1, "server", server)
+}
+
+// TunnelFailed 隧道连接内网目标失败
+func TunnelFailed(server, target, reason string) {
+	Metrics.Add(MetricTunnelsFailed, 1, "server", server, "target", target, "reason", reason)
+}
+
+// CountBytes 统计内网目标的传输字节，direction为in或out
+func CountBytes(target, direction string, n int) {
+	if n > 0 {
+		Metrics.Add(MetricBytes, float64(n), "target", target, "direction", direction)
+	}
+}
+
+// MetricsServe 本地监控指标
+func MetricsServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = Metrics.WriteTo(w)
+	})
+	log.Infof("Metrics listen: http://%s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Metrics listen failed, Addr: %s, Error: %+v", addr, err)
+	}
+}
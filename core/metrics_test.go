@@ -0,0 +1,51 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsBucketOrder(t *testing.T) {
+	m := &MetricSet{values: make(map[string]map[string]float64)}
+	m.Observe(MetricDialSeconds, 0.02, "target", "tcp://b")
+	m.Observe(MetricDialSeconds, 3, "target", "tcp://a")
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	var bounds []string
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if strings.HasPrefix(line, MetricDialSeconds+`_bucket{target="tcp://a"`) {
+			bounds = append(bounds, line[strings.Index(line, `le="`)+4:strings.LastIndex(line, `"`)])
+		}
+	}
+	want := "0.001 0.005 0.01 0.025 0.05 0.1 0.25 0.5 1 2.5 5 10 +Inf"
+	if got := strings.Join(bounds, " "); got != want {
+		t.Fatalf("buckets out of order:\n got %s\nwant %s", got, want)
+	}
+	if !strings.Contains(sb.String(), MetricDialSeconds+`_bucket{target="tcp://b",le="0.025"} 1`) {
+		t.Fatalf("missing cumulative bucket:\n%s", sb.String())
+	}
+}
+
+func TestAuthSuccessMetric(t *testing.T) {
+	connHandler := &ConnectHandler{}
+	natok := &NatokHandler{Main: connHandler, Conf: &NatokConnConfig{Addr: "auth.test:1001"}}
+	handler := &NatokServerHandler{NatokHandler: natok, ConnHandler: connHandler}
+	label := labels("server", "auth.test:1001", "type", "success")
+	count := func() float64 {
+		Metrics.mu.Lock()
+		defer Metrics.mu.Unlock()
+		return Metrics.values[MetricAuthResults][label]
+	}
+	before := count()
+	handler.Receive(connHandler, Message{Type: TypeDisabledAccessKey})
+	if count() != before {
+		t.Fatal("auth failure counted as success")
+	}
+	handler.Receive(connHandler, Message{Type: TypeHeartbeat})
+	handler.Receive(connHandler, Message{Type: TypeHeartbeat})
+	if count()-before != 1 {
+		t.Fatalf("expected one auth success per control connection, got %v", count()-before)
+	}
+}
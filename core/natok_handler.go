@@ -3,19 +3,24 @@ package core
 import (
 	"crypto/tls"
 	"encoding/binary"
-	"fmt"
 	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
 	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // NatokServerHandler struct NATOK服务处理
 type NatokServerHandler struct {
 	Chan         chan struct{}
-	AccessKey    string //密钥
-	source       string //来源
-	target       string //目标
+	AccessKey    string                     //密钥
+	udp          atomic.Pointer[UdpHandler] //UDP隧道
+	tunnel       atomic.Pointer[Tunnel]     //当前隧道
+	heartbeat    int64                      //待应答心跳的发送时间
+	authed       atomic.Bool                //控制连接已认证成功
 	NatokHandler *NatokHandler
 	ConnHandler  *ConnectHandler
 }
@@ -28,14 +33,107 @@ type NatokConfig struct {
 
 // NatokHandler struct // Natok句柄
 type NatokHandler struct {
-	count Counter           //数量
-	Conf  *NatokConnConfig  //配置
-	Conns []*ConnectHandler //连接
+	count     Counter           //数量
+	AccessKey string            //密钥
+	Conf      *NatokConnConfig  //配置
+	Conns     []*ConnectHandler //连接
+	Main      *ConnectHandler   //控制连接
+	Features  Features          //服务端支持的特性
+	Negotiate bool              //认证后通告客户端特性
+	state     serverState       //连接状态
 }
 
 type NatokConnConfig struct {
-	Addr string
-	Conf *tls.Config
+	Addr      string
+	Conf      *tls.Config
+	Proxy     *ProxyDialer    //代理，为空时直连
+	WebSocket *conf.WebSocket //WebSocket传输，为空时使用TLS直连
+	Command   string          //外部命令传输，每个连接启动一个进程
+	Quic      *QuicSession    //QUIC传输，每个连接对应一个流
+	Dialer    NetDialer       //地址族偏好与本地地址
+}
+
+// Dial 连接natok-server，控制连接与数据连接共用
+func (p *NatokConnConfig) Dial(timeout time.Duration) (net.Conn, error) {
+	if p.Quic != nil {
+		return p.Quic.OpenStream(timeout)
+	}
+	var conn net.Conn
+	var err error
+	dialer := p.Dialer
+	dialer.Timeout = timeout
+	if p.Command != "" {
+		conn, err = DialCommand(p.Command, p.Addr)
+	} else if p.Proxy != nil {
+		proxy := *p.Proxy
+		proxy.Forward = dialer.Dial
+		conn, err = proxy.Dial("tcp", p.Addr)
+	} else {
+		conn, err = dialer.Dial("tcp", p.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.WebSocket != nil {
+		return p.dialWebSocket(conn, timeout)
+	}
+	if p.Conf == nil {
+		return conn, nil
+	}
+	tlsConf := p.Conf
+	if tlsConf.ServerName == "" {
+		tlsConf = tlsConf.Clone()
+		tlsConf.ServerName, _, _ = net.SplitHostPort(p.Addr)
+	}
+	tlsConn := tls.Client(conn, tlsConf)
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialWebSocket 建立WebSocket传输，natok数据流由wss承载
+func (p *NatokConnConfig) dialWebSocket(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	ws := p.WebSocket
+	wsUrl := &url.URL{Scheme: ws.Scheme, Host: p.Addr, Path: ws.Path}
+	if wsUrl.Scheme == "" {
+		wsUrl.Scheme = "wss"
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	raw := conn
+	if wsUrl.Scheme == "wss" {
+		// 沿用natok的TLS配置，保留客户端证书与根证书
+		tlsConf := &tls.Config{}
+		if p.Conf != nil {
+			tlsConf = p.Conf.Clone()
+		}
+		if tlsConf.ServerName == "" {
+			tlsConf.ServerName, _, _ = net.SplitHostPort(p.Addr)
+		}
+		if ws.InsecureSkipVerify {
+			tlsConf.InsecureSkipVerify = true
+		}
+		tlsConn := tls.Client(conn, tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = raw.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	wsConn, err := WsHandshake(conn, wsUrl, ws.Origin, ws.Headers)
+	if err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return wsConn, nil
 }
 
 // Get 获取连接
@@ -43,13 +141,8 @@ func (p *NatokConnConfig) Get() (*ConnectHandler, error) {
 	var conn net.Conn
 	var err error
 	retries := 5
-	dialer := net.Dialer{Timeout: 2 * time.Second}
 	for tries := 0; tries <= retries; tries++ {
-		if p.Conf != nil {
-			conn, err = tls.DialWithDialer(&dialer, "tcp", p.Addr, p.Conf)
-		} else {
-			conn, err = dialer.Dial("tcp", p.Addr)
-		}
+		conn, err = p.Dial(2 * time.Second)
 		if err == nil {
 			break
 		}
@@ -64,9 +157,10 @@ func (p *NatokConnConfig) Get() (*ConnectHandler, error) {
 		return nil, err
 	}
 	connHandler := &ConnectHandler{
-		Name:   "natok-server-子集",
-		Active: true,
-		Conn:   conn,
+		Name:    "natok-server-子集",
+		BufSize: p.Dialer.Socket.BufferSize,
+		Active:  true,
+		Conn:    conn,
 	}
 	return connHandler, nil
 }
@@ -124,24 +218,31 @@ func (s *NatokServerHandler) Decode(buf []byte) (interface{}, int) {
 func (s *NatokServerHandler) Receive(connHandler *ConnectHandler, msgData interface{}) {
 	msg := msgData.(Message)
 	//log.Println("Received connect message:", msg.Uri, "=>", string(msg.Data))
+	// 认证无单独的成功应答，控制连接收到首个非认证失败的消息即视为成功
+	if s.NatokHandler != nil && s.NatokHandler.Main == connHandler && !authFailure(msg.Type) && s.authed.CompareAndSwap(false, true) {
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "success")
+	}
 	switch msg.Type {
 	// 连接到natok服务
 	case TypeConnectNatok:
 		go func() {
-			log.Debugf("1-1 ===== From natok server message: %s %s", msg.Serial, string(msg.Data))
+			s.logger().WithField("serial", msg.Serial).Debugf("1-1 ===== From natok server message: %s", string(msg.Data))
 			if natokHandler, err := s.NatokHandler.Conf.Get(); err == nil {
 				natokServerHandler := &NatokServerHandler{
-					AccessKey:   s.AccessKey,
-					ConnHandler: natokHandler,
+					AccessKey:    s.AccessKey,
+					NatokHandler: s.NatokHandler,
+					ConnHandler:  natokHandler,
 				}
-				log.Debugf("1-2 =====Connect natok, Listen natok server message: %s %s", msg.Serial, string(msg.Data))
+				natokServerHandler.tunnel.Store(NewTunnel(s.server(), msg.Serial, func() { _ = natokHandler.Conn.Close() }))
+				natokServerHandler.logger().Debugf("1-2 =====Connect natok, Listen natok server message: %s", string(msg.Data))
 				natokHandler.MsgHandler = natokServerHandler
 				natokServerHandler.HeartBeat()
 				natokHandler.Write(Message{Type: TypeConnectNatok, Serial: msg.Serial, Uri: s.AccessKey})
 				natokHandler.Listen()
-				log.Debugf("1-3 =====Disconnect natok, Listen natok server message: %s %s", msg.Serial, string(msg.Data))
+				natokServerHandler.tunnel.Load().Remove()
+				natokServerHandler.logger().Debugf("1-3 =====Disconnect natok, Listen natok server message: %s", string(msg.Data))
 			} else {
-				log.Errorf("1-e =====Connect natok server failed, Message: %s %s, Error: %+v", msg.Serial, string(msg.Data), err)
+				s.logger().WithField("serial", msg.Serial).Errorf("1-e =====Connect natok server failed, Message: %s, Error: %+v", string(msg.Data), err)
 			}
 		}()
 	// 连接到内部服务
@@ -149,61 +250,121 @@ func (s *NatokServerHandler) Receive(connHandler *ConnectHandler, msgData interf
 		go func() {
 			network := msg.Net
 			addr := string(msg.Data)
-			s.source = fmt.Sprintf("%s://%s", network, addr)
-			s.target = msg.Uri
-			sprintf := fmt.Sprintf("%s %s -> %s", msg.Serial, s.source, s.target)
-			log.Debugf("2-1 ===== From natok server message: %s", sprintf)
-			if conn, err := net.Dial(network, addr); err == nil {
-				intraHandler := &ConnectHandler{Name: network + addr, Conn: conn, Active: true, ConnHandler: connHandler}
+			// 数据连接复用时按新的序列登记
+			tunnel := s.tunnel.Load()
+			if tunnel == nil || tunnel.Serial != msg.Serial || FindTunnel(tunnel.Server, tunnel.Serial) != tunnel {
+				tunnel = NewTunnel(s.server(), msg.Serial, func() { _ = connHandler.Conn.Close() })
+				s.tunnel.Store(tunnel)
+			}
+			tunnel.Dial(network, msg.Uri, addr)
+			tunnel.Logger().Debugf("2-1 ===== From natok server message, Source: %s", msg.Uri)
+			if strings.HasPrefix(network, "udp") {
+				s.connectUdp(connHandler, msg, tunnel)
+				return
+			}
+			if conn, err := DialIntra(network, addr, msg.Uri, tunnel); err == nil {
+				intraHandler := &ConnectHandler{Name: network + addr, BufSize: IntraSocket(addr).BufferSize, Conn: conn, Active: true, ConnHandler: connHandler}
+				tunnel.Open(func() { _ = conn.Close() })
 				intraHandler.MsgHandler = &IntraServerHandler{
 					Uri:            msg.Uri,
 					AccessKey:      s.AccessKey,
+					Tunnel:         tunnel,
 					connectHandler: connHandler,
 				}
 				connHandler.ConnHandler = intraHandler
 				connHandler.Write(Message{Type: TypeConnectIntra, Serial: msg.Serial, Uri: s.AccessKey})
-				log.Debugf("2-2 =====Connect intranet, Listen natok server message: %s", sprintf)
+				tunnel.Logger().Debug("2-2 =====Connect intranet, Listen natok server message")
 				intraHandler.Listen()
-				log.Debugf("2-3 =====Disconnect intranet, Listen natok server message: %s", sprintf)
+				tunnel.Remove()
+				tunnel.Logger().Debug("2-3 =====Disconnect intranet, Listen natok server message")
 			} else {
-				log.Errorf("2-e =====Connect intranet server failed, Message: %s, Error: %+v", sprintf, err)
+				tunnel.Logger().Errorf("2-e =====Connect intranet server failed, Source: %s, Error: %+v", msg.Uri, err)
+				tunnel.Fail(err)
+				connHandler.Write(DisconnectMessage(msg.Serial, msg.Uri, DialReason(err)))
 			}
 		}()
 	// 传输数据 - 转发内部服务
 	case TypeTransfer:
-		sprintf := fmt.Sprintf("%s %s -> %s", msg.Serial, s.source, s.target)
-		log.Debugf("3-1 =====TypeTransfer natok server message: %s", sprintf)
-		if conn := connHandler.ConnHandler; conn != nil {
-			log.Debugf("3-2 =====TypeTransfer intranet server message: %s", sprintf)
+		s.logger().Debug("3-1 =====TypeTransfer natok server message")
+		if udp := s.udp.Load(); udp != nil {
+			udp.Transfer(msg.Data)
+		} else if conn := connHandler.ConnHandler; conn != nil {
+			s.logger().Debug("3-2 =====TypeTransfer intranet server message")
 			conn.Write(msg.Data)
+			s.tunnel.Load().In(len(msg.Data))
 		}
 	// 关闭连接 - 断开内部服务
 	case TypeDisconnect:
-		sprintf := fmt.Sprintf("%s %s -> %s", msg.Serial, s.source, s.target)
-		log.Debugf("4-1 =====TypeDisconnect natok server message: %s", sprintf)
+		s.logger().Debug("4-1 =====TypeDisconnect natok server message")
+		if udp := s.udp.Swap(nil); udp != nil {
+			udp.Close()
+		}
 		if conn := connHandler.ConnHandler; conn != nil {
 			_ = conn.Conn.Close()
 			connHandler.ConnHandler = nil
 		}
+	// 特性协商 - natok-server支持的特性
+	case TypeFeature:
+		if s.NatokHandler != nil && s.NatokHandler.Main == connHandler {
+			s.NatokHandler.Features.Set(strings.Split(string(msg.Data), ","))
+			s.logger().Infof("Natok server features: %v", s.NatokHandler.Features.List())
+			s.NatokHandler.ReportHealth(HealthStatus()...)
+		}
+	// 心跳应答
+	case TypeHeartbeat:
+		if sent := atomic.SwapInt64(&s.heartbeat, 0); sent > 0 {
+			rtt := time.Since(time.Unix(0, sent))
+			Metrics.Set(MetricHeartbeatRtt, rtt.Seconds(), "server", s.server())
+		}
 	case typeNoAvailablePort:
-		log.Warnf("Natok access key %s no available ports.", msg.Uri)
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "typeNoAvailablePort")
+		s.logger().Warnf("Natok access key %s no available ports.", msg.Uri)
 	case TypeDisabledAccessKey:
-		log.Warnf("Natok access key %s is disabled.", msg.Uri)
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "TypeDisabledAccessKey")
+		s.logger().Warnf("Natok access key %s is disabled.", msg.Uri)
 	case TypeInvalidKey:
-		log.Errorf("Natok access key %s is not valid.", msg.Uri)
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "TypeInvalidKey")
+		s.logger().Errorf("Natok access key %s is not valid.", msg.Uri)
 		s.Close(connHandler)
 		os.Exit(1)
 	case TypeIsInuseKey:
-		log.Warnf("Natok access key %s is in use by other natok client.", msg.Uri)
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "TypeIsInuseKey")
+		s.logger().Warnf("Natok access key %s is in use by other natok client.", msg.Uri)
 		s.Close(connHandler)
 		os.Exit(1)
 	case TypeDisabledTrialClient:
-		log.Infof("Natok access key %s is overuse.", msg.Uri)
+		Metrics.Add(MetricAuthResults, 1, "server", s.server(), "type", "TypeDisabledTrialClient")
+		s.logger().Infof("Natok access key %s is overuse.", msg.Uri)
 		s.Close(connHandler)
 		os.Exit(1)
 	}
 }
 
+// authFailure 认证失败的消息类型
+func authFailure(msgType byte) bool {
+	switch msgType {
+	case typeNoAvailablePort, TypeDisabledAccessKey, TypeInvalidKey, TypeIsInuseKey, TypeDisabledTrialClient:
+		return true
+	}
+	return false
+}
+
+// server natok-server地址，用于监控指标
+func (s *NatokServerHandler) server() string {
+	if s.NatokHandler == nil || s.NatokHandler.Conf == nil {
+		return ""
+	}
+	return s.NatokHandler.Conf.Addr
+}
+
+// logger 日志，数据连接附带当前隧道的序列与内网目标
+func (s *NatokServerHandler) logger() *log.Entry {
+	if tunnel := s.tunnel.Load(); tunnel != nil {
+		return tunnel.Logger()
+	}
+	return log.WithField("server", s.server())
+}
+
 // Auth 认证成功
 func (s *NatokServerHandler) Auth() {
 	if s.AccessKey == "" {
@@ -211,13 +372,25 @@ func (s *NatokServerHandler) Auth() {
 	}
 	msg := Message{Type: TypeAuth, Serial: "1", Net: "tcp", Uri: s.AccessKey, Data: []byte("8888")}
 	s.ConnHandler.Write(msg)
+	// 通告客户端特性，仅在配置开启时发送，未开启时不使用任何扩展特性
+	if s.NatokHandler == nil {
+		return
+	}
+	s.NatokHandler.Features.Set(nil)
+	if s.NatokHandler.Negotiate {
+		s.ConnHandler.Write(Message{Type: TypeFeature, Uri: s.AccessKey, Data: []byte(strings.Join(ClientFeatures, ","))})
+	}
 }
 
 // Error 错误处理
 func (s *NatokServerHandler) Error(connHandler *ConnectHandler) {
+	s.tunnel.Load().Closing(CloseReasonServer)
 	if s.Chan != nil {
 		close(s.Chan)
 	}
+	if udp := s.udp.Load(); udp != nil {
+		udp.Close()
+	}
 	intraHandler := connHandler.ConnHandler
 	if intraHandler != nil {
 		if conn := intraHandler.Conn; conn != nil {
@@ -235,6 +408,9 @@ func (s *NatokServerHandler) Close(connHandler *ConnectHandler) {
 	if s.Chan != nil {
 		close(s.Chan)
 	}
+	if udp := s.udp.Load(); udp != nil {
+		udp.Close()
+	}
 	if intraHandler := connHandler.ConnHandler; intraHandler != nil {
 		if intraHandler.Conn != nil {
 			intraHandler.Active = false
@@ -244,11 +420,9 @@ func (s *NatokServerHandler) Close(connHandler *ConnectHandler) {
 		}
 		connHandler.ConnHandler = nil
 	}
-	if connHandler.Conn != nil {
-		connHandler.Active = false
-		_ = connHandler.Conn.Close()
-		connHandler.Conn = nil
-	}
+	connHandler.Active = false
+	connHandler.CloseConn()
+	connHandler.SetConn(nil)
 	s.ConnHandler = nil
 	connHandler.MsgHandler = nil
 }
@@ -264,6 +438,7 @@ func (s *NatokServerHandler) HeartBeat() {
 				// 若通道在30s内未收到过数据，则发送一次心跳包。
 				if now.Sub(s.ConnHandler.ReadTime) >= 30*time.Second {
 					msg := Message{Type: TypeHeartbeat, Uri: s.AccessKey}
+					atomic.StoreInt64(&s.heartbeat, time.Now().UnixNano())
 					s.ConnHandler.Write(msg)
 				}
 			case <-s.Chan:
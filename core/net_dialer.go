@@ -0,0 +1,214 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"strings"
+	"time"
+)
+
+// 地址竞速间隔，参考RFC 8305
+const attemptDelay = 250 * time.Millisecond
+
+// testHookDial 测试中替换单个地址的连接，模拟不可达的地址族
+var testHookDial func(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error)
+
+// NetDialer struct 拨号器，每次连接重新解析域名，并按地址族偏好竞速连接所有地址
+type NetDialer struct {
+	IpVersion string          //地址族偏好：v4、v6、auto（默认）
+	LocalAddr string          //本地地址
+	Interface string          //本地网卡，绑定网卡上与目标地址族相同的地址，出口仍由路由表决定
+	Socket    conf.SocketConf //套接字选项
+	Timeout   time.Duration   //连接超时，为0时不限制
+}
+
+// Bound 是否绑定本地地址
+func (d *NetDialer) Bound() bool {
+	return d.LocalAddr != "" || d.Interface != ""
+}
+
+// LocalIP 与目标地址族相同的本地地址，未绑定时返回nil；指定网卡时仅绑定其地址，不使用SO_BINDTODEVICE
+func (d *NetDialer) LocalIP(remote net.IP) (net.IP, error) {
+	if d.LocalAddr != "" {
+		ip := net.ParseIP(d.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", d.LocalAddr)
+		}
+		if (ip.To4() != nil) != (remote.To4() != nil) {
+			return nil, fmt.Errorf("local address %s does not match %s", ip, remote)
+		}
+		return ip, nil
+	}
+	if d.Interface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(d.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != (remote.To4() != nil) {
+			continue
+		}
+		if !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+		if linkLocal == nil {
+			linkLocal = ipNet.IP
+		}
+	}
+	if linkLocal != nil && remote.IsLinkLocalUnicast() {
+		return linkLocal, nil
+	}
+	return nil, fmt.Errorf("interface %s has no address for %s", d.Interface, remote)
+}
+
+// dial 连接单个地址，按需绑定本地地址
+func (d *NetDialer) dial(ctx context.Context, network string, ip net.IP, port string) (net.Conn, error) {
+	dialer := net.Dialer{KeepAlive: keepAlive(d.Socket)}
+	local, err := d.LocalIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	if local != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: local}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+	}
+	address := net.JoinHostPort(ip.String(), port)
+	var conn net.Conn
+	if testHookDial != nil {
+		conn, err = testHookDial(ctx, &dialer, network, address)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	TuneConn(conn, d.Socket)
+	return conn, nil
+}
+
+// Resolve 解析主机地址，按地址族偏好过滤并交替排序
+func (d *NetDialer) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch d.IpVersion {
+	case "v4":
+		v6 = nil
+	case "v6":
+		v4 = nil
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("no %s address found for %s", d.IpVersion, host)
+	}
+	// IPv6优先，两个地址族交替尝试
+	ips := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	return ips, nil
+}
+
+// Dial 连接地址
+func (d *NetDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 依次发起连接，前一个地址未在竞速间隔内完成时并行尝试下一个，采用最先成功的连接
+func (d *NetDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	ips, err := d.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Resolved %s -> %v", host, ips)
+	if len(ips) == 1 {
+		return d.dial(ctx, network, ips[0], port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next, pending = next+1, pending+1
+		go func() {
+			conn, err := d.dial(ctx, network, ip, port)
+			results <- result{conn, err}
+		}()
+	}
+	start()
+	delay := time.NewTimer(attemptDelay)
+	defer delay.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭其余竞速成功的连接
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				delay.Reset(attemptDelay)
+			}
+		case <-delay.C:
+			if next < len(ips) {
+				start()
+				delay.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"context"
+	"natok-cli/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetDialerResolve(t *testing.T) {
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{
+		"dual.test": "10.0.0.1,10.0.0.2,10.0.0.3,fd00::1,fd00::2",
+		"v4.test":   "10.0.0.1",
+	}})
+	defer InitResolver(nil)
+	cases := []struct {
+		host, version string
+		want          []string
+	}{
+		{"dual.test", "", []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2", "10.0.0.3"}},
+		{"dual.test", "v4", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"dual.test", "v6", []string{"fd00::1", "fd00::2"}},
+		{"v4.test", "v6", nil},
+		{"fd00::9", "", []string{"fd00::9"}},
+	}
+	for _, item := range cases {
+		dialer := &NetDialer{IpVersion: item.version}
+		ips, err := dialer.Resolve(context.Background(), item.host)
+		if item.want == nil {
+			if err == nil {
+				t.Fatalf("%s %s: expected error, got %v", item.host, item.version, ips)
+			}
+			continue
+		}
+		if err != nil || len(ips) != len(item.want) {
+			t.Fatalf("%s %s: %v %v, want %v", item.host, item.version, ips, err, item.want)
+		}
+		for i, ip := range ips {
+			if ip.String() != item.want[i] {
+				t.Fatalf("%s %s: %v, want %v", item.host, item.version, ips, item.want)
+			}
+		}
+	}
+}
+
+// dialAttempt struct 记录的连接尝试
+type dialAttempt struct {
+	addr  string
+	start time.Time
+	err   error
+}
+
+// stubDial 替换单个地址的连接：IPv6地址不可达，阻塞至取消，IPv4地址正常连接
+func stubDial(t *testing.T) <-chan dialAttempt {
+	t.Helper()
+	attempts := make(chan dialAttempt, 8)
+	testHookDial = func(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+		start := time.Now()
+		host, _, _ := net.SplitHostPort(address)
+		if net.ParseIP(host).To4() == nil {
+			<-ctx.Done()
+			attempts <- dialAttempt{address, start, ctx.Err()}
+			return nil, ctx.Err()
+		}
+		conn, err := dialer.DialContext(ctx, network, address)
+		attempts <- dialAttempt{address, start, err}
+		return conn, err
+	}
+	return attempts
+}
+
+func TestNetDialerFallbackDelay(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	_, port, _ := net.SplitHostPort(addr)
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{"dual.test": "127.0.0.1,fd00::1"}})
+	defer InitResolver(nil)
+	attempts := stubDial(t)
+	defer func() { testHookDial = nil }()
+
+	start := time.Now()
+	conn, err := (&NetDialer{}).Dial("tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	<-accepted
+	// IPv4首先完成，IPv6的尝试随之取消
+	v4, v6 := <-attempts, <-attempts
+	if v4.addr != addr || v4.err != nil || v6.err != context.Canceled {
+		t.Fatalf("unexpected attempts: %+v %+v", v4, v6)
+	}
+	// IPv6优先尝试，未完成时间隔250ms再尝试IPv4
+	if delay := v4.start.Sub(start); delay < attemptDelay-50*time.Millisecond || delay > attemptDelay+500*time.Millisecond {
+		t.Fatalf("ipv4 attempt started after %s", delay)
+	}
+	if v6.start.Sub(start) > 100*time.Millisecond {
+		t.Fatalf("ipv6 attempt started after %s", v6.start.Sub(start))
+	}
+}
+
+func TestNetDialerFallbackOnError(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	_, port, _ := net.SplitHostPort(addr)
+	// 无服务监听的地址立即失败，不等待竞速间隔
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{"dual.test": "127.0.0.1,::1"}})
+	defer InitResolver(nil)
+	probe, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback unavailable")
+	}
+	_ = probe.Close()
+	start := time.Now()
+	conn, err := (&NetDialer{}).Dial("tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	<-accepted
+	if elapsed := time.Since(start); elapsed >= attemptDelay {
+		t.Fatalf("fallback took %s", elapsed)
+	}
+	if conn.RemoteAddr().String() != addr {
+		t.Fatalf("connected to %s", conn.RemoteAddr())
+	}
+}
+
+func TestNetDialerIpVersion(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	_, port, _ := net.SplitHostPort(addr)
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{"dual.test": "fd00::1,127.0.0.1"}})
+	defer InitResolver(nil)
+	attempts := stubDial(t)
+	defer func() { testHookDial = nil }()
+
+	// 仅使用IPv4时不尝试IPv6，立即连接
+	start := time.Now()
+	conn, err := (&NetDialer{IpVersion: "v4"}).Dial("tcp", net.JoinHostPort("dual.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	<-accepted
+	if attempt := <-attempts; attempt.addr != addr || time.Since(start) >= attemptDelay {
+		t.Fatalf("unexpected attempt %+v after %s", attempt, time.Since(start))
+	}
+	select {
+	case attempt := <-attempts:
+		t.Fatalf("unexpected attempt %+v", attempt)
+	default:
+	}
+	// 仅使用IPv6时不可达的地址超时失败
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = (&NetDialer{IpVersion: "v6"}).DialContext(ctx, "tcp", net.JoinHostPort("dual.test", port)); err == nil {
+		t.Fatal("ipv6 only dial succeeded")
+	}
+	<-attempts
+}
+
+// testInterfaces 本机的回环网卡，以及缺少某一地址族的网卡与其缺少的地址族样例地址
+func testInterfaces(t *testing.T) (string, string, net.IP) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback, partial string
+	var missing net.IP
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		v4, v6 := false, false
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				v4, v6 = v4 || ipNet.IP.To4() != nil, v6 || ipNet.IP.To4() == nil
+			}
+		}
+		if iface.Flags&net.FlagLoopback != 0 && v4 && loopback == "" {
+			loopback = iface.Name
+		}
+		if partial == "" && !v4 {
+			partial, missing = iface.Name, net.ParseIP("192.0.2.1")
+		} else if partial == "" && !v6 {
+			partial, missing = iface.Name, net.ParseIP("2001:db8::1")
+		}
+	}
+	if loopback == "" {
+		t.Skip("no ipv4 loopback interface")
+	}
+	return loopback, partial, missing
+}
+
+func TestNetDialerLocalIP(t *testing.T) {
+	loopback, partial, missing := testInterfaces(t)
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	type localCase struct {
+		name   string
+		dialer NetDialer
+		remote net.IP
+		want   string
+		err    bool
+	}
+	cases := []localCase{
+		{"unbound", NetDialer{}, v4, "<nil>", false},
+		{"address", NetDialer{LocalAddr: "198.51.100.9"}, v4, "198.51.100.9", false},
+		{"address family mismatch", NetDialer{LocalAddr: "198.51.100.9"}, v6, "", true},
+		{"invalid address", NetDialer{LocalAddr: "wan0"}, v4, "", true},
+		{"interface", NetDialer{Interface: loopback}, v4, "127.0.0.1", false},
+		{"unknown interface", NetDialer{Interface: "natok-missing0"}, v4, "", true},
+		// 同时配置时优先使用本地地址
+		{"address over interface", NetDialer{LocalAddr: "198.51.100.9", Interface: loopback}, v4, "198.51.100.9", false},
+	}
+	if partial != "" {
+		// 网卡缺少目标地址族时报错
+		cases = append(cases, localCase{"interface without family", NetDialer{Interface: partial}, missing, "", true})
+	}
+	for _, item := range cases {
+		ip, err := item.dialer.LocalIP(item.remote)
+		if (err != nil) != item.err || (err == nil && ip.String() != item.want) {
+			t.Fatalf("%s: %v %v, want %s error %v", item.name, ip, err, item.want, item.err)
+		}
+	}
+	if (&NetDialer{}).Bound() || !(&NetDialer{Interface: loopback}).Bound() || !(&NetDialer{LocalAddr: "127.0.0.1"}).Bound() {
+		t.Fatal("unexpected bound state")
+	}
+}
+
+func TestNetDialerBind(t *testing.T) {
+	loopback, _, _ := testInterfaces(t)
+	addr, accepted := listenTcp(t)
+	for _, dialer := range []*NetDialer{{Interface: loopback}, {LocalAddr: "127.0.0.1"}} {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend := <-accepted
+		// 连接的本地地址为绑定的地址
+		if host, _, _ := net.SplitHostPort(backend.RemoteAddr().String()); host != "127.0.0.1" {
+			t.Fatalf("%+v: bound %s", dialer, backend.RemoteAddr())
+		}
+		_ = backend.Close()
+		_ = conn.Close()
+	}
+}
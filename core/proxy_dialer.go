@@ -0,0 +1,219 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyDialer struct 经由上游代理连接，支持 http://、https:// CONNECT 与 socks5://
+type ProxyDialer struct {
+	Url     *url.URL                                     //代理地址
+	Timeout time.Duration                                //握手超时
+	Forward func(network, addr string) (net.Conn, error) //连接代理服务器
+}
+
+// NewProxyDialer 解析代理地址
+func NewProxyDialer(rawUrl string, forward func(network, addr string) (net.Conn, error)) (*ProxyDialer, error) {
+	proxyUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyUrl.Scheme)
+	}
+	if proxyUrl.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[proxyUrl.Scheme]
+		proxyUrl.Host = net.JoinHostPort(proxyUrl.Hostname(), port)
+	}
+	if forward == nil {
+		forward = (&NetDialer{}).Dial
+	}
+	return &ProxyDialer{Url: proxyUrl, Timeout: 10 * time.Second, Forward: forward}, nil
+}
+
+// ServerProxy 解析natok-server代理：none为直连，为空时读取HTTPS_PROXY与NO_PROXY环境变量
+func ServerProxy(setting, addr string) (*ProxyDialer, error) {
+	switch setting {
+	case "none", "direct":
+		return nil, nil
+	case "":
+		req := &http.Request{URL: &url.URL{Scheme: "https", Host: addr}}
+		proxyUrl, err := http.ProxyFromEnvironment(req)
+		if err != nil || proxyUrl == nil {
+			return nil, err
+		}
+		setting = proxyUrl.String()
+	}
+	return NewProxyDialer(setting, nil)
+}
+
+// Dial 经由代理连接目标地址，仅支持tcp
+func (p *ProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("network %s is not supported via proxy %s", network, p.Url.Redacted())
+	}
+	conn, err := p.Forward("tcp", p.Url.Host)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(p.Timeout))
+	if p.Url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.Url.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if p.Url.Scheme == "socks5" || p.Url.Scheme == "socks5h" {
+		err = p.socks5(conn, addr)
+	} else {
+		conn, err = p.connect(conn, addr)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", p.Url.Redacted(), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect HTTP CONNECT握手
+func (p *ProxyDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := p.Url.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.New("connect " + addr + ": " + resp.Status)
+	}
+	// 代理已发送的数据需先读出
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// socks5 SOCKS5握手，支持用户名密码认证
+func (p *ProxyDialer) socks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	methods := []byte{0x00}
+	if p.Url.User != nil {
+		methods = append(methods, 0x02)
+	}
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.New("socks5: invalid version")
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		username := p.Url.User.Username()
+		password, _ := p.Url.User.Password()
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: connect %s failed, code %d", addr, head[1])
+	}
+	// 跳过绑定地址
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0]) + 2
+	default:
+		return errors.New("socks5: invalid address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// bufferedConn struct 带读缓冲的连接
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoServer 本地回显服务
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// proxyStandIn 进程内代理，handshake完成握手并返回目标地址
+func proxyStandIn(t *testing.T, handshake func(conn net.Conn) (string, error)) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	targets := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				addr, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				targets <- addr
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer func() { _ = upstream.Close() }()
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+// connectHandshake HTTP CONNECT代理，校验Basic认证
+func connectHandshake(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != want {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", io.EOF
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, err
+}
+
+// socks5Handshake SOCKS5代理，校验用户名密码认证
+func socks5Handshake(conn net.Conn) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+		return "", err
+	}
+	_, _ = conn.Write([]byte{0x05, 0x02})
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	username := make([]byte, head[1])
+	_, _ = io.ReadFull(conn, username)
+	size := make([]byte, 1)
+	_, _ = io.ReadFull(conn, size)
+	password := make([]byte, size[0])
+	_, _ = io.ReadFull(conn, password)
+	if string(username) != "user" || string(password) != "pass" {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return "", io.EOF
+	}
+	_, _ = conn.Write([]byte{0x01, 0x00})
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		_, _ = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		_, _ = io.ReadFull(conn, size)
+		name := make([]byte, size[0])
+		_, _ = io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return "", io.EOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	_, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), err
+}
+
+// roundTrip 经由连接回显一次数据
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo via proxy: %q %v", buf, err)
+	}
+}
+
+func TestProxyDialerConnect(t *testing.T) {
+	echo := echoServer(t)
+	proxy, targets := proxyStandIn(t, connectHandshake)
+	dialer, err := NewProxyDialer("http://user:pass@"+proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	if got := <-targets; got != echo {
+		t.Fatalf("proxy asked for %s, want %s", got, echo)
+	}
+
+	dialer, _ = NewProxyDialer("http://user:wrong@"+proxy, nil)
+	if conn, err = dialer.Dial("tcp", echo); err == nil {
+		_ = conn.Close()
+		t.Fatal("expected proxy authentication failure")
+	}
+}
+
+func TestProxyDialerSocks5(t *testing.T) {
+	echo := echoServer(t)
+	proxy, targets := proxyStandIn(t, socks5Handshake)
+	dialer, err := NewProxyDialer("socks5://user:pass@"+proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	if got := <-targets; got != echo {
+		t.Fatalf("proxy asked for %s, want %s", got, echo)
+	}
+
+	// 域名由代理解析
+	_, port, _ := net.SplitHostPort(echo)
+	conn, err = dialer.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	if got := <-targets; got != net.JoinHostPort("localhost", port) {
+		t.Fatalf("proxy asked for %s", got)
+	}
+}
+
+func TestTargetViaProxy(t *testing.T) {
+	echo := echoServer(t)
+	proxy, targets := proxyStandIn(t, socks5Handshake)
+	if err := InitTargets([]conf.Target{{Addr: echo, Proxy: "socks5://user:pass@" + proxy}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = InitTargets(nil) }()
+	conn, err := DialIntra("tcp", echo, "203.0.113.1:1000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	if got := <-targets; got != echo {
+		t.Fatalf("target was not dialed through the proxy: %s", got)
+	}
+}
+
+func TestTargetProxyFailClosed(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	err := InitTargets([]conf.Target{{Addr: addr, Proxy: "ftp://proxy.invalid:21"}})
+	defer func() { _ = InitTargets(nil) }()
+	if err == nil {
+		t.Fatal("expected proxy config error")
+	}
+	if conn, err := DialIntra("tcp", addr, "203.0.113.1:1000", nil); err == nil {
+		_ = conn.Close()
+		t.Fatal("target with broken proxy config must not be dialed directly")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("direct connection reached the target")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY协议v2签名
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// ParseSource 解析公网来源地址，支持 ip:port 与 network://ip:port
+func ParseSource(source string) (net.IP, int, bool) {
+	if idx := strings.Index(source, "://"); idx != -1 {
+		source = source[idx+3:]
+	}
+	host, port, err := net.SplitHostPort(source)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, 0, false
+	}
+	return ip, p, true
+}
+
+// ProxyHeader 构建PROXY协议头，version为v1或v2，dst为后端地址
+func ProxyHeader(version, network, source, dst string) []byte {
+	srcIP, srcPort, ok := ParseSource(source)
+	dstIP, dstPort, dok := ParseSource(dst)
+	ok = ok && dok
+	udp := strings.HasPrefix(network, "udp")
+	if version == "v2" || version == "2" {
+		return proxyHeaderV2(ok, udp, srcIP, srcPort, dstIP, dstPort)
+	}
+	if !ok || udp {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	// 地址族不一致时统一按IPv6处理
+	if srcIP.To4() == nil || dstIP.To4() == nil {
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), srcPort, dstPort))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP.To4(), dstIP.To4(), srcPort, dstPort))
+}
+
+// ipv6String 以IPv6形式输出地址，IPv4映射为::ffff:a.b.c.d
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// proxyHeaderV2 构建PROXY协议v2二进制头
+func proxyHeaderV2(ok, udp bool, srcIP net.IP, srcPort int, dstIP net.IP, dstPort int) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 52))
+	buf.Write(proxyV2Signature)
+	if !ok {
+		// LOCAL命令，不携带地址
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	buf.WriteByte(0x21)
+	proto := byte(0x01)
+	if udp {
+		proto = 0x02
+	}
+	var addr []byte
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		buf.WriteByte(0x10 | proto)
+		addr = append(addr, src4...)
+		addr = append(addr, dst4...)
+	} else {
+		buf.WriteByte(0x20 | proto)
+		addr = append(addr, srcIP.To16()...)
+		addr = append(addr, dstIP.To16()...)
+	}
+	addr = binary.BigEndian.AppendUint16(addr, uint16(srcPort))
+	addr = binary.BigEndian.AppendUint16(addr, uint16(dstPort))
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(addr)))
+	buf.Write(addr)
+	return buf.Bytes()
+}
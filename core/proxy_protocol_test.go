@@ -0,0 +1,93 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"natok-cli/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	cases := []struct {
+		network, src, dst, want string
+	}{
+		{"tcp", "203.0.113.7:52814", "10.0.0.5:8080", "PROXY TCP4 203.0.113.7 10.0.0.5 52814 8080\r\n"},
+		{"tcp", "tcp://203.0.113.7:52814", "10.0.0.5:8080", "PROXY TCP4 203.0.113.7 10.0.0.5 52814 8080\r\n"},
+		{"tcp", "[2001:db8::1]:1000", "[2001:db8::2]:80", "PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n"},
+		{"tcp", "203.0.113.7:1000", "[2001:db8::2]:80", "PROXY TCP6 ::ffff:203.0.113.7 2001:db8::2 1000 80\r\n"},
+		{"tcp", "", "10.0.0.5:8080", "PROXY UNKNOWN\r\n"},
+		{"tcp", "203.0.113.7:1000", "app.local:8080", "PROXY UNKNOWN\r\n"},
+		{"udp", "203.0.113.7:1000", "10.0.0.5:53", "PROXY UNKNOWN\r\n"},
+	}
+	for _, item := range cases {
+		if got := string(ProxyHeader("v1", item.network, item.src, item.dst)); got != item.want {
+			t.Errorf("%s %s -> %s: got %q, want %q", item.network, item.src, item.dst, got, item.want)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	sig := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	cases := []struct {
+		name, network, src, dst string
+		want                    []byte
+	}{
+		{"tcp4", "tcp", "203.0.113.7:52814", "10.0.0.5:8080", join(sig,
+			[]byte{0x21, 0x11, 0x00, 0x0C},
+			[]byte{203, 0, 113, 7}, []byte{10, 0, 0, 5},
+			[]byte{0xCE, 0x4E}, []byte{0x1F, 0x90})},
+		{"udp4", "udp", "203.0.113.7:53", "10.0.0.5:5353", join(sig,
+			[]byte{0x21, 0x12, 0x00, 0x0C},
+			[]byte{203, 0, 113, 7}, []byte{10, 0, 0, 5},
+			[]byte{0x00, 0x35}, []byte{0x14, 0xE9})},
+		{"tcp6", "tcp", "[2001:db8::1]:1000", "[2001:db8::2]:80", join(sig,
+			[]byte{0x21, 0x21, 0x00, 0x24},
+			net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16(),
+			[]byte{0x03, 0xE8}, []byte{0x00, 0x50})},
+		{"udp6", "udp", "203.0.113.7:53", "[2001:db8::2]:53", join(sig,
+			[]byte{0x21, 0x22, 0x00, 0x24},
+			net.ParseIP("::ffff:203.0.113.7").To16(), net.ParseIP("2001:db8::2").To16(),
+			[]byte{0x00, 0x35}, []byte{0x00, 0x35})},
+		{"local", "tcp", "", "10.0.0.5:8080", join(sig, []byte{0x20, 0x00, 0x00, 0x00})},
+	}
+	for _, item := range cases {
+		if got := ProxyHeader("v2", item.network, item.src, item.dst); !bytes.Equal(got, item.want) {
+			t.Errorf("%s: got % x\nwant % x", item.name, got, item.want)
+		}
+	}
+}
+
+func TestProxyHeaderViaUpstreamProxy(t *testing.T) {
+	backend, accepted := listenTcp(t)
+	proxy, _ := proxyStandIn(t, socks5Handshake)
+	dialer, err := NewProxyDialer("socks5://user:pass@"+proxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &TargetHandler{Proxy: dialer, Conf: conf.Target{Addr: backend, ProxyProtocol: "v1"}}
+	conn, err := target.Dial("tcp", backend, "203.0.113.7:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend not reached")
+	}
+	defer func() { _ = server.Close() }()
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 目的地址为后端而非上游代理
+	_, port, _ := net.SplitHostPort(backend)
+	if want := "PROXY TCP4 203.0.113.7 127.0.0.1 5000 " + port + "\r\n"; line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+}
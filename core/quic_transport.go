@@ -0,0 +1,240 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"sync"
+	"time"
+)
+
+// QUIC应用层协议
+const QuicProto = "natok"
+
+// QuicSession struct QUIC会话，控制通道与每个隧道各占用一个流
+type QuicSession struct {
+	mu     sync.Mutex
+	Addr   string         //natok-server地址
+	Conf   *tls.Config    //TLS配置
+	Quic   *conf.QuicConf //QUIC配置
+	Dialer NetDialer      //地址族偏好与本地地址
+	conn   *quic.Conn     //当前连接
+	local  string         //当前出口地址
+}
+
+// QuicStreamConn struct QUIC流连接
+type QuicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *QuicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *QuicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close 关闭流的读写两端
+func (c *QuicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// NewQuicSession 创建QUIC会话
+func NewQuicSession(addr string, tlsConf *tls.Config, cfg *conf.QuicConf) *QuicSession {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{QuicProto}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if cfg == nil {
+		cfg = &conf.QuicConf{}
+	}
+	return &QuicSession{Addr: addr, Conf: tlsConf, Quic: cfg}
+}
+
+// OpenStream 打开新的流，连接断开时重新建立
+func (q *QuicSession) OpenStream(timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := q.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QuicStreamConn{Stream: stream, conn: conn}, nil
+}
+
+// connect 获取当前连接
+func (q *QuicSession) connect(ctx context.Context) (*quic.Conn, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn != nil && q.conn.Context().Err() == nil {
+		return q.conn, nil
+	}
+	host, port, err := net.SplitHostPort(q.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// 每次重连重新解析，按地址族偏好依次尝试
+	ips, err := q.Dialer.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn *quic.Conn
+	var tr *quic.Transport
+	for i, ip := range ips {
+		// 设置超时时各地址平分剩余时间
+		attempt, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attempt, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(ips)-i))
+		}
+		conn, tr, err = q.dial(attempt, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			break
+		}
+		log.Debugf("Quic connect natok server %s via %s failed, Error: %+v", q.Addr, ip, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Quic connected natok server %s, Local: %s", q.Addr, conn.LocalAddr())
+	q.conn = conn
+	q.local = outboundIP(conn.RemoteAddr())
+	// 绑定本地地址时出口固定，无需迁移
+	if !q.Quic.DisableMigration && !q.Dialer.Bound() {
+		go q.migrate(conn, tr)
+	} else {
+		go func() {
+			<-conn.Context().Done()
+			_ = tr.Close()
+		}()
+	}
+	return conn, nil
+}
+
+// dial 经由新的UDP套接字连接指定地址
+func (q *QuicSession) dial(ctx context.Context, address string) (*quic.Conn, *quic.Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := q.Dialer.LocalIP(addr.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		return nil, nil, err
+	}
+	TuneConn(udpConn, q.Dialer.Socket)
+	tr := &quic.Transport{Conn: udpConn}
+	config := &quic.Config{
+		KeepAlivePeriod: time.Duration(q.Quic.KeepAlive) * time.Second,
+		MaxIdleTimeout:  time.Duration(q.Quic.IdleTimeout) * time.Second,
+	}
+	if config.KeepAlivePeriod <= 0 {
+		config.KeepAlivePeriod = HeartbeatInterval * time.Second
+	}
+	conn, err := tr.Dial(ctx, addr, q.Conf, config)
+	if err != nil {
+		_ = tr.Close()
+		return nil, nil, err
+	}
+	return conn, tr, nil
+}
+
+// migrate 出口地址变化时迁移连接，设备切换网络后隧道无需重建；
+// 连接注册过的传输关闭时连接随之关闭，因此只在初始传输与一个备用传输之间交替切换，两者均绑定通配地址
+func (q *QuicSession) migrate(conn *quic.Conn, origin *quic.Transport) {
+	var spare *quic.Transport
+	active, paths := origin, make(map[*quic.Transport]*quic.Path)
+	ticker := time.NewTicker(5 * time.Second)
+	defer func() {
+		ticker.Stop()
+		_ = origin.Close()
+		if spare != nil {
+			_ = spare.Close()
+		}
+	}()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		local := outboundIP(conn.RemoteAddr())
+		q.mu.Lock()
+		changed := local != "" && local != q.local
+		q.mu.Unlock()
+		if !changed {
+			continue
+		}
+		next := origin
+		if active == origin {
+			if spare == nil {
+				udpConn, err := net.ListenUDP("udp", nil)
+				if err != nil {
+					continue
+				}
+				spare = &quic.Transport{Conn: udpConn}
+			}
+			next = spare
+		}
+		if err := switchPath(conn, next, paths); err != nil {
+			log.Warnf("Quic migration to %s failed, Error: %+v", local, err)
+			continue
+		}
+		active = next
+		q.mu.Lock()
+		q.local = local
+		q.mu.Unlock()
+		log.Infof("Quic connection migrated, Local: %s", local)
+	}
+}
+
+// switchPath 经由指定传输切换连接路径；验证通过的路径保留复用，避免每次迁移占用新的连接ID
+func switchPath(conn *quic.Conn, tr *quic.Transport, paths map[*quic.Transport]*quic.Path) error {
+	if path, ok := paths[tr]; ok {
+		return path.Switch()
+	}
+	path, err := conn.AddPath(tr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = path.Probe(ctx)
+	cancel()
+	if err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		_ = path.Close()
+		return err
+	}
+	paths[tr] = path
+	return nil
+}
+
+// outboundIP 获取连接对端时使用的出口地址，对端为已建立连接的地址，不经域名解析，不发送数据
+func outboundIP(remote net.Addr) string {
+	addr, ok := remote.(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = conn.Close() }()
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return host
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/quic-go/quic-go"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+// quicStandIn 本地QUIC服务，每个流回显数据
+func quicStandIn(t *testing.T) (string, *tls.Config) {
+	t.Helper()
+	cert := selfSigned(t, "natok.test")
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{QuicProto}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer func() { _ = stream.Close() }()
+						_, _ = io.Copy(stream, stream)
+					}()
+				}
+			}()
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	return listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "natok.test"}
+}
+
+// quicSession 连接本地QUIC服务的会话，不启用迁移
+func quicSession(addr string, tlsConf *tls.Config) *QuicSession {
+	return NewQuicSession(addr, tlsConf, &conf.QuicConf{DisableMigration: true})
+}
+
+func TestQuicStreamEcho(t *testing.T) {
+	addr, tlsConf := quicStandIn(t)
+	q := quicSession(addr, tlsConf)
+	for i := 0; i < 2; i++ {
+		conn, err := q.OpenStream(2 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_ = q.conn.CloseWithError(0, "")
+}
+
+func TestQuicAddressFallback(t *testing.T) {
+	addr, tlsConf := quicStandIn(t)
+	_, port, _ := net.SplitHostPort(addr)
+	// 首个地址无服务监听，回退至下一个地址
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{"natok.test": "127.0.0.2,127.0.0.1"}})
+	defer InitResolver(nil)
+	q := quicSession(net.JoinHostPort("natok.test", port), tlsConf)
+	conn, err := q.OpenStream(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, conn)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if got := q.conn.RemoteAddr().String(); got != addr {
+		t.Fatalf("connected to %s, want %s", got, addr)
+	}
+	_ = q.conn.CloseWithError(0, "")
+}
+
+func TestQuicPathSwitch(t *testing.T) {
+	addr, tlsConf := quicStandIn(t)
+	q := quicSession(addr, tlsConf)
+	conn, origin, err := q.dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.CloseWithError(0, ""); _ = origin.Close() }()
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spare := &quic.Transport{Conn: udpConn}
+	defer func() { _ = spare.Close() }()
+	// 在初始传输与备用传输之间多次往返切换，连接持续可用
+	paths := make(map[*quic.Transport]*quic.Path)
+	for i, tr := range []*quic.Transport{spare, origin, spare, origin, spare} {
+		if err = switchPath(conn, tr, paths); err != nil {
+			t.Fatalf("switch %d: %v", i, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		stream, err := conn.OpenStreamSync(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, &QuicStreamConn{Stream: stream, conn: conn})
+	}
+}
+
+func TestQuicOutboundIP(t *testing.T) {
+	addr, tlsConf := quicStandIn(t)
+	_, port, _ := net.SplitHostPort(addr)
+	InitResolver(&conf.DnsConf{Hosts: map[string]string{"natok.test": "127.0.0.1"}})
+	defer InitResolver(nil)
+	q := quicSession(net.JoinHostPort("natok.test", port), tlsConf)
+	conn, err := q.OpenStream(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	// 出口地址按已建立连接的对端探测，域名仅由静态解析可得
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.local != "127.0.0.1" {
+		t.Fatalf("outbound ip %q", q.local)
+	}
+	if got := outboundIP(q.conn.RemoteAddr()); got != "127.0.0.1" {
+		t.Fatalf("probe via remote address %q", got)
+	}
+	_ = q.conn.CloseWithError(0, "")
+}
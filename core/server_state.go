@@ -0,0 +1,119 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// serverState struct natok-server连接状态
+type serverState struct {
+	mu         sync.Mutex
+	connected  bool          //控制连接已建立
+	paused     bool          //已暂停
+	since      time.Time     //状态变化时间
+	reconnects int           //重连次数
+	once       bool          //曾经连接成功
+	resume     chan struct{} //恢复通知
+}
+
+// ServerState struct natok-server连接状态
+type ServerState struct {
+	Addr       string    `json:"addr"`
+	Connected  bool      `json:"connected"`
+	Paused     bool      `json:"paused"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	Features   []string  `json:"features"`
+	Tunnels    int       `json:"tunnels"`
+}
+
+// SetConnected 更新控制连接状态
+func (p *NatokHandler) SetConnected(connected bool) {
+	s := &p.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connected && s.once {
+		s.reconnects++
+		Metrics.Add(MetricReconnects, 1, "server", p.Conf.Addr)
+	}
+	s.once = s.once || connected
+	s.connected = connected
+	s.since = time.Now()
+	value := 0.0
+	if connected {
+		value = 1
+	}
+	Metrics.Set(MetricServerConnected, value, "server", p.Conf.Addr)
+}
+
+// Pause 暂停：断开控制连接且不再重连，已建立的隧道不受影响
+func (p *NatokHandler) Pause() {
+	s := &p.state
+	s.mu.Lock()
+	if !s.paused {
+		s.paused = true
+		s.resume = make(chan struct{})
+	}
+	s.mu.Unlock()
+	if p.Main != nil {
+		p.Main.CloseConn()
+	}
+}
+
+// Resume 恢复连接
+func (p *NatokHandler) Resume() {
+	s := &p.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		s.paused = false
+		close(s.resume)
+	}
+}
+
+// Paused 是否已暂停
+func (p *NatokHandler) Paused() bool {
+	s := &p.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// WaitResume 暂停时等待恢复
+func (p *NatokHandler) WaitResume() {
+	s := &p.state
+	s.mu.Lock()
+	paused, resume := s.paused, s.resume
+	s.mu.Unlock()
+	if paused {
+		<-resume
+	}
+}
+
+// State 连接状态
+func (p *NatokHandler) State() ServerState {
+	s := &p.state
+	s.mu.Lock()
+	state := ServerState{
+		Addr:       p.Conf.Addr,
+		Connected:  s.connected,
+		Paused:     s.paused,
+		Since:      s.since,
+		Reconnects: s.reconnects,
+	}
+	s.mu.Unlock()
+	state.Features = p.Features.List()
+	for _, tunnel := range Tunnels() {
+		if tunnel.Server == state.Addr {
+			state.Tunnels++
+		}
+	}
+	return state
+}
+
+// NatokServers 已注册的natok-server
+func NatokServers() []*NatokHandler {
+	natokMu.Lock()
+	defer natokMu.Unlock()
+	return append([]*NatokHandler(nil), natokHandlers...)
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientHello最大缓冲
+const maxClientHelloSize = 16 * 1024
+
+var (
+	errHelloIncomplete = errors.New("tls client hello incomplete")
+	errHelloInvalid    = errors.New("not a tls client hello")
+)
+
+// SniConn struct 按TLS ClientHello中的SNI选择内网服务的连接，不终止TLS
+type SniConn struct {
+	mu      sync.Mutex
+	wmu     sync.Mutex                          //写入锁，连接后端期间不阻塞其它操作
+	Routes  []conf.SniRoute                     //路由表
+	Default string                              //默认内网地址
+	Dial    func(addr string) (net.Conn, error) //后端连接
+	buf     []byte                              //已窥探的数据
+	conn    net.Conn                            //后端连接
+	err     error                               //连接错误
+	ready   chan struct{}                       //后端就绪
+	once    sync.Once
+}
+
+// sniAddr struct 后端连接前的占位地址
+type sniAddr string
+
+func (a sniAddr) Network() string { return "sni" }
+func (a sniAddr) String() string  { return string(a) }
+
+// NewSniConn 创建按SNI路由的内网连接，收到ClientHello后才连接后端
+func NewSniConn(routes []conf.SniRoute, def string, dial func(string) (net.Conn, error)) *SniConn {
+	return &SniConn{Routes: routes, Default: def, Dial: dial, ready: make(chan struct{})}
+}
+
+// Write 写入来自隧道的数据，ClientHello完整前仅缓冲
+func (c *SniConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.conn != nil || c.err != nil {
+		conn, err := c.conn, c.err
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return conn.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	buf := c.buf
+	c.mu.Unlock()
+	name, err := ParseSni(buf)
+	if err == errHelloIncomplete && len(buf) < maxClientHelloSize {
+		return len(b), nil
+	}
+	addr := c.Match(name)
+	log.Debugf("Sni route %q -> %s", name, addr)
+	// 连接后端时不持有锁，Close等操作不被阻塞
+	conn, err := c.Dial(addr)
+	if err == nil {
+		// 回放已窥探的数据
+		_, err = conn.Write(buf)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = nil
+	if err == nil && c.err != nil {
+		// 连接期间已关闭
+		err = c.err
+	}
+	if err != nil {
+		c.err = err
+		if conn != nil {
+			_ = conn.Close()
+		}
+		c.once.Do(func() { close(c.ready) })
+		return 0, err
+	}
+	c.conn = conn
+	c.once.Do(func() { close(c.ready) })
+	return len(b), nil
+}
+
+// Read 读取后端数据，后端就绪前阻塞
+func (c *SniConn) Read(b []byte) (int, error) {
+	<-c.ready
+	c.mu.Lock()
+	conn, err := c.conn, c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
+
+// Close 关闭连接
+func (c *SniConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.once.Do(func() { close(c.ready) })
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// Match 匹配SNI路由，未匹配时使用默认内网地址
+func (c *SniConn) Match(name string) string {
+	name = strings.ToLower(name)
+	for _, route := range c.Routes {
+		if matchHost(strings.ToLower(route.Host), name) {
+			return route.Addr
+		}
+	}
+	return c.Default
+}
+
+func (c *SniConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+	return sniAddr("sni")
+}
+
+func (c *SniConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return sniAddr(c.Default)
+}
+
+func (c *SniConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *SniConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *SniConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// ParseSni 从TLS记录中解析ClientHello的SNI，ClientHello可跨多个记录
+func ParseSni(buf []byte) (string, error) {
+	// 拼接握手消息
+	var hello []byte
+	for len(buf) > 0 {
+		if buf[0] != 0x16 {
+			return "", errHelloInvalid
+		}
+		if len(buf) < 5 {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(buf[3:5]))
+		if len(buf) < 5+size {
+			break
+		}
+		hello = append(hello, buf[5:5+size]...)
+		buf = buf[5+size:]
+		if len(hello) >= 4 && len(hello) >= 4+(int(hello[1])<<16|int(hello[2])<<8|int(hello[3])) {
+			break
+		}
+	}
+	if len(hello) < 4 {
+		return "", errHelloIncomplete
+	}
+	if hello[0] != 0x01 {
+		return "", errHelloInvalid
+	}
+	size := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])
+	if len(hello) < 4+size {
+		return "", errHelloIncomplete
+	}
+	body := hello[4 : 4+size]
+
+	// client_version(2) + random(32)
+	pos := 34
+	if len(body) < pos+1 {
+		return "", errHelloInvalid
+	}
+	// session_id
+	pos += 1 + int(body[pos])
+	if len(body) < pos+2 {
+		return "", errHelloInvalid
+	}
+	// cipher_suites
+	pos += 2 + int(binary.BigEndian.Uint16(body[pos:]))
+	if len(body) < pos+1 {
+		return "", errHelloInvalid
+	}
+	// compression_methods
+	pos += 1 + int(body[pos])
+	if len(body) < pos {
+		return "", errHelloInvalid
+	}
+	if len(body) < pos+2 {
+		// 无扩展
+		return "", nil
+	}
+	end := pos + 2 + int(binary.BigEndian.Uint16(body[pos:]))
+	if end > len(body) {
+		return "", errHelloInvalid
+	}
+	pos += 2
+	for pos+4 <= end {
+		extType := binary.BigEndian.Uint16(body[pos:])
+		extLen := int(binary.BigEndian.Uint16(body[pos+2:]))
+		pos += 4
+		if pos+extLen > end {
+			return "", errHelloInvalid
+		}
+		if extType == 0x0000 {
+			ext := body[pos : pos+extLen]
+			if len(ext) < 2 {
+				return "", errHelloInvalid
+			}
+			list := ext[2:]
+			for len(list) >= 3 {
+				nameType := list[0]
+				nameLen := int(binary.BigEndian.Uint16(list[1:]))
+				if len(list) < 3+nameLen {
+					return "", errHelloInvalid
+				}
+				if nameType == 0 {
+					return string(list[3 : 3+nameLen]), nil
+				}
+				list = list[3+nameLen:]
+			}
+			return "", nil
+		}
+		pos += extLen
+	}
+	return "", nil
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"natok-cli/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello 经由crypto/tls生成的ClientHello记录，name为空时不携带SNI
+func clientHello(t *testing.T, name string) []byte {
+	t.Helper()
+	server, client := net.Pipe()
+	defer func() { _ = server.Close() }()
+	go func() {
+		defer func() { _ = client.Close() }()
+		_ = tls.Client(client, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// tlsRecords 将握手消息按size分片为多个TLS记录
+func tlsRecords(msg []byte, size int) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		out = append(out, 0x16, 0x03, 0x01, byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// handshake 以body构造ClientHello握手消息
+func handshake(body []byte) []byte {
+	n := len(body)
+	return append([]byte{0x01, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func TestParseSni(t *testing.T) {
+	hello := clientHello(t, "app.natok.test")
+	msg := hello[5:]
+	split := tlsRecords(msg, 40)
+	cases := []struct {
+		name  string
+		input []byte
+		sni   string
+		err   error
+	}{
+		{"crypto/tls", hello, "app.natok.test", nil},
+		{"split records", split, "app.natok.test", nil},
+		{"first record only", split[:45], "", errHelloIncomplete},
+		{"record header", hello[:4], "", errHelloIncomplete},
+		{"record body", hello[:len(hello)-1], "", errHelloIncomplete},
+		{"empty", nil, "", errHelloIncomplete},
+		{"no sni", clientHello(t, ""), "", nil},
+		{"ip address", clientHello(t, "127.0.0.1"), "", nil},
+		{"application data", append([]byte{0x17}, hello[1:]...), "", errHelloInvalid},
+		{"http request", []byte("GET / HTTP/1.1\r\n\r\n"), "", errHelloInvalid},
+		{"server hello", tlsRecords(append([]byte{0x02}, msg[1:]...), 1<<14), "", errHelloInvalid},
+		{"no extensions", tlsRecords(handshake(make([]byte, 34+1+2+1+1)), 1<<14), "", nil},
+	}
+	for _, item := range cases {
+		if sni, err := ParseSni(item.input); sni != item.sni || err != item.err {
+			t.Fatalf("%s: %q %v, want %q %v", item.name, sni, err, item.sni, item.err)
+		}
+	}
+}
+
+func TestParseSniTruncated(t *testing.T) {
+	body := clientHello(t, "app.natok.test")[9:]
+	// 定位各长度字段
+	session := 34
+	suites := session + 1 + int(body[session])
+	compression := suites + 2 + int(binary.BigEndian.Uint16(body[suites:]))
+	extensions := compression + 1 + int(body[compression])
+	sni := extensions + 2
+	for sni+4 <= len(body) && binary.BigEndian.Uint16(body[sni:]) != 0 {
+		sni += 4 + int(binary.BigEndian.Uint16(body[sni+2:]))
+	}
+	if sni+4 > len(body) {
+		t.Fatal("server_name extension not found")
+	}
+	fields := map[string]int{
+		"session_id":          session,
+		"cipher_suites":       suites,
+		"compression_methods": compression,
+		"extensions":          extensions + 1,
+		"extension":           sni + 2,
+		"server_name_list":    sni + 4,
+		"server_name":         sni + 4 + 3,
+	}
+	// 握手消息完整但在长度字段处截断，长度越界为无效
+	for field, cut := range fields {
+		for _, n := range []int{cut, cut + 1} {
+			sni, err := ParseSni(tlsRecords(handshake(body[:n]), 1<<14))
+			if err != errHelloInvalid && !(field == "extensions" && n == cut && err == nil && sni == "") {
+				t.Fatalf("truncated at %s (%d): %q %v", field, n, sni, err)
+			}
+		}
+	}
+	// 任意位置截断均不越界
+	for n := range body {
+		if sni, err := ParseSni(tlsRecords(handshake(body[:n]), 1<<14)); err == nil && sni != "" {
+			t.Fatalf("truncated at %d parsed %q", n, sni)
+		}
+	}
+}
+
+func TestSniConnRoute(t *testing.T) {
+	routed, routedConns := listenTcp(t)
+	fallback, fallbackConns := listenTcp(t)
+	routes := []conf.SniRoute{{Host: "*.natok.test", Addr: routed}}
+	dial := func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+	for _, item := range []struct {
+		name     string
+		expected <-chan net.Conn
+	}{{"app.natok.test", routedConns}, {"other.test", fallbackConns}} {
+		hello := clientHello(t, item.name)
+		conn := NewSniConn(routes, fallback, dial)
+		// ClientHello分两次写入，完整前不连接后端
+		if _, err := conn.Write(hello[:10]); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := conn.RemoteAddr().(sniAddr); !ok {
+			t.Fatalf("%s: backend dialed before client hello complete", item.name)
+		}
+		if _, err := conn.Write(hello[10:]); err != nil {
+			t.Fatal(err)
+		}
+		backend := <-item.expected
+		// 后端收到回放的完整ClientHello
+		_ = backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+		replayed := make([]byte, len(hello))
+		if _, err := io.ReadFull(backend, replayed); err != nil || !bytes.Equal(replayed, hello) {
+			t.Fatalf("%s: replay mismatch, Error: %v", item.name, err)
+		}
+		if _, err := conn.Write([]byte("after")); err != nil {
+			t.Fatal(err)
+		}
+		after := make([]byte, 5)
+		if _, err := io.ReadFull(backend, after); err != nil || string(after) != "after" {
+			t.Fatalf("%s: forwarded %q, Error: %v", item.name, after, err)
+		}
+		_, _ = backend.Write([]byte("reply"))
+		reply := make([]byte, 5)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+			t.Fatalf("%s: reply %q, Error: %v", item.name, reply, err)
+		}
+		_ = conn.Close()
+		_ = backend.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+	"natok-cli/conf"
+	"net"
+	"time"
+)
+
+// SocketOptions 合并套接字配置，后者的非零项覆盖前者
+func SocketOptions(list ...*conf.SocketConf) conf.SocketConf {
+	var opts conf.SocketConf
+	for _, item := range list {
+		if item == nil {
+			continue
+		}
+		if item.KeepAlive != 0 {
+			opts.KeepAlive = item.KeepAlive
+		}
+		if item.NoDelay != nil {
+			opts.NoDelay = item.NoDelay
+		}
+		if item.ReadBuffer > 0 {
+			opts.ReadBuffer = item.ReadBuffer
+		}
+		if item.WriteBuffer > 0 {
+			opts.WriteBuffer = item.WriteBuffer
+		}
+		if item.BufferSize > 0 {
+			opts.BufferSize = item.BufferSize
+		}
+	}
+	return opts
+}
+
+// IntraSocket 内网地址的套接字配置
+func IntraSocket(addr string) conf.SocketConf {
+	if target := FindTarget(addr); target != nil {
+		return target.dialer(0).Socket
+	}
+	return SocketOptions(conf.AppConf().Natok.Socket)
+}
+
+// keepAlive 保活间隔，0为系统默认，负数为禁用
+func keepAlive(opts conf.SocketConf) time.Duration {
+	return time.Duration(opts.KeepAlive) * time.Second
+}
+
+// TuneConn 设置TCP_NODELAY与收发缓冲区
+func TuneConn(conn net.Conn, opts conf.SocketConf) {
+	var err error
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		if opts.NoDelay != nil {
+			err = c.SetNoDelay(*opts.NoDelay)
+		}
+		if err == nil && opts.ReadBuffer > 0 {
+			err = c.SetReadBuffer(opts.ReadBuffer)
+		}
+		if err == nil && opts.WriteBuffer > 0 {
+			err = c.SetWriteBuffer(opts.WriteBuffer)
+		}
+	case *net.UDPConn:
+		if opts.ReadBuffer > 0 {
+			err = c.SetReadBuffer(opts.ReadBuffer)
+		}
+		if err == nil && opts.WriteBuffer > 0 {
+			err = c.SetWriteBuffer(opts.WriteBuffer)
+		}
+	}
+	if err != nil {
+		log.Warnf("Socket options for %s failed, Error: %+v", conn.LocalAddr(), err)
+	}
+}
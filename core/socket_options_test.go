@@ -0,0 +1,74 @@
+package core
+
+import (
+	"natok-cli/conf"
+	"net"
+	"testing"
+)
+
+func TestSocketOptions(t *testing.T) {
+	off := false
+	opts := SocketOptions(&conf.SocketConf{KeepAlive: 30, ReadBuffer: 1 << 20}, nil, &conf.SocketConf{NoDelay: &off, ReadBuffer: 2 << 20})
+	if opts.KeepAlive != 30 || opts.NoDelay == nil || *opts.NoDelay || opts.ReadBuffer != 2<<20 || opts.WriteBuffer != 0 {
+		t.Fatalf("unexpected merged options: %+v", opts)
+	}
+}
+
+// benchCopy 经由本地TCP连接单向传输，读取端按BufferSize分块读取，与隧道转发一致
+func benchCopy(b *testing.B, opts conf.SocketConf) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 1024 * 64
+	}
+	done := make(chan int64)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(done)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		TuneConn(conn, opts)
+		var total int64
+		buf := make([]byte, size)
+		for {
+			n, err := conn.Read(buf)
+			total += int64(n)
+			if err != nil {
+				done <- total
+				return
+			}
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	TuneConn(conn, opts)
+	chunk := make([]byte, size)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = conn.Close()
+	if total := <-done; total != int64(b.N)*int64(len(chunk)) {
+		b.Fatalf("received %d bytes, want %d", total, int64(b.N)*int64(len(chunk)))
+	}
+}
+
+func BenchmarkCopyDefault(b *testing.B) {
+	benchCopy(b, conf.SocketConf{})
+}
+
+func BenchmarkCopyTuned(b *testing.B) {
+	off := false
+	benchCopy(b, conf.SocketConf{NoDelay: &off, ReadBuffer: 4 << 20, WriteBuffer: 4 << 20, BufferSize: 256 << 10})
+}
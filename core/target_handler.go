@@ -0,0 +1,307 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"natok-cli/conf"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Backend struct 后端服务
+type Backend struct {
+	mu      sync.RWMutex
+	Addr    string    //地址
+	healthy bool      //是否健康
+	checked time.Time //检查时间
+	err     string    //最近错误
+	rise    int       //连续成功次数
+	fall    int       //连续失败次数
+}
+
+// TargetHandler struct 内网目标处理
+type TargetHandler struct {
+	next     uint32        //轮询序号
+	Conf     conf.Target   //配置
+	Backends []*Backend    //后端
+	TlsConf  *tls.Config   //内网TLS配置
+	Proxy    *ProxyDialer  //上游代理
+	err      error         //配置错误，出错的内网目标拒绝连接
+	stop     chan struct{} //停止健康检查
+}
+
+// ErrTargetDenied 连接前拒绝：内网目标已停用或无健康后端
+var ErrTargetDenied = errors.New("intranet target denied")
+
+// 内网目标，重新加载配置时整体替换
+var (
+	targetMu sync.RWMutex
+	targets  = make(map[string]*TargetHandler)
+)
+
+// InitTargets 初始化内网目标并启动健康检查，替换已有的内网目标；
+// 配置出错的内网目标仍然登记，但拒绝连接，避免绕过TLS、代理等配置直接连接
+func InitTargets(list []conf.Target) error {
+	var errs []error
+	handlers := make(map[string]*TargetHandler, len(list))
+	for _, item := range list {
+		target := &TargetHandler{Conf: item, stop: make(chan struct{})}
+		if item.Tls != nil {
+			tlsConf, err := IntraTlsConfig(item.Tls)
+			if err != nil {
+				target.fail(fmt.Errorf("tls config: %w", err))
+				errs = append(errs, target.err)
+				handlers[item.Addr] = target
+				continue
+			}
+			target.TlsConf = tlsConf
+		}
+		if rawUrl := item.Proxy; rawUrl != "" {
+			if named, ok := conf.AppConf().Natok.Proxies[rawUrl]; ok {
+				rawUrl = named
+			}
+			dialer := target.dialer(0)
+			proxy, err := NewProxyDialer(rawUrl, dialer.Dial)
+			if err != nil {
+				target.fail(fmt.Errorf("proxy config: %w", err))
+				errs = append(errs, target.err)
+				handlers[item.Addr] = target
+				continue
+			}
+			target.Proxy = proxy
+		}
+		backends := item.Backends
+		if len(backends) == 0 {
+			backends = []string{item.Addr}
+		}
+		for _, addr := range backends {
+			target.Backends = append(target.Backends, &Backend{Addr: addr, healthy: true})
+		}
+		handlers[item.Addr] = target
+		if item.HealthCheck != nil {
+			for _, backend := range target.Backends {
+				go target.HealthCheck(backend)
+			}
+		}
+	}
+	targetMu.Lock()
+	old := targets
+	targets = handlers
+	targetMu.Unlock()
+	for _, target := range old {
+		close(target.stop)
+	}
+	return errors.Join(errs...)
+}
+
+// fail 配置出错，内网目标停用
+func (t *TargetHandler) fail(err error) {
+	t.err = fmt.Errorf("intranet target %s: %w", t.Conf.Addr, err)
+	log.Errorf("Intranet target %s config failed, target is disabled, Error: %+v", t.Conf.Addr, err)
+	backends := t.Conf.Backends
+	if len(backends) == 0 {
+		backends = []string{t.Conf.Addr}
+	}
+	for _, addr := range backends {
+		t.Backends = append(t.Backends, &Backend{Addr: addr, err: err.Error()})
+	}
+}
+
+// FindTarget 查找内网目标
+func FindTarget(addr string) *TargetHandler {
+	targetMu.RLock()
+	defer targetMu.RUnlock()
+	return targets[addr]
+}
+
+// Targets 全部内网目标
+func Targets() []*TargetHandler {
+	targetMu.RLock()
+	defer targetMu.RUnlock()
+	list := make([]*TargetHandler, 0, len(targets))
+	for _, target := range targets {
+		list = append(list, target)
+	}
+	return list
+}
+
+// Pick 轮询选取健康的后端地址，内网目标停用或无健康后端时拒绝连接
+func (t *TargetHandler) Pick() (string, error) {
+	if t.err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTargetDenied, t.err)
+	}
+	size := len(t.Backends)
+	start := atomic.AddUint32(&t.next, 1)
+	for i := 0; i < size; i++ {
+		backend := t.Backends[(int(start)+i)%size]
+		if backend.Healthy() {
+			return backend.Addr, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no healthy backend for %s", ErrTargetDenied, t.Conf.Addr)
+}
+
+// Healthy 是否健康
+func (b *Backend) Healthy() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.healthy
+}
+
+// DialIntra 连接内网服务，source为公网来源地址，tunnel为所属隧道
+func DialIntra(network, addr, source string, tunnel *Tunnel) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dialIntra(network, addr, source, tunnel)
+	Metrics.Observe(MetricDialSeconds, time.Since(start).Seconds(), "target", network+"://"+addr)
+	return conn, err
+}
+
+// dialIntra 连接内网服务，按内网目标配置选取后端
+func dialIntra(network, addr, source string, tunnel *Tunnel) (net.Conn, error) {
+	target := FindTarget(addr)
+	if target == nil {
+		return dialAddr(network, addr, NetDialer{Socket: SocketOptions(conf.AppConf().Natok.Socket)})
+	}
+	backend, err := target.Pick()
+	if err != nil {
+		return nil, err
+	}
+	dial := func(addr string) (net.Conn, error) {
+		return target.Dial(network, addr, source)
+	}
+	// 收到ClientHello后再按SNI连接后端
+	if len(target.Conf.Sni) > 0 {
+		return NewSniConn(target.Conf.Sni, backend, dial), nil
+	}
+	conn, err := dial(backend)
+	if err != nil {
+		return nil, err
+	}
+	if target.Conf.Http != nil {
+		host := backend
+		if network, _ = SplitAddr(network, backend); strings.HasPrefix(network, "unix") {
+			host = "localhost"
+		}
+		return NewHttpConn(conn, target.Conf.Http, host, source, dial, tunnel.Logger()), nil
+	}
+	return conn, nil
+}
+
+// Dial 连接内网目标的后端服务
+func (t *TargetHandler) Dial(network, addr, source string) (net.Conn, error) {
+	return t.dial(network, addr, source, 0)
+}
+
+// dial 经由上游代理连接后端，写入PROXY协议头并完成TLS握手，与健康检查共用；
+// timeout为连接与握手的超时，0为系统默认
+func (t *TargetHandler) dial(network, addr, source string, timeout time.Duration) (net.Conn, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	var conn net.Conn
+	var err error
+	proxied := t.Proxy != nil && !strings.HasPrefix(addr, "unix://")
+	if proxied {
+		conn, err = t.Proxy.Dial(network, addr)
+	} else {
+		conn, err = dialAddr(network, addr, t.dialer(timeout))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	// PROXY协议头须先于转发数据写入
+	if version := t.Conf.ProxyProtocol; version != "" {
+		dst := conn.RemoteAddr().String()
+		if proxied {
+			dst = proxyDestination(addr)
+		}
+		header := ProxyHeader(version, network, source, dst)
+		if _, err = conn.Write(header); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if t.TlsConf != nil {
+		if conn, err = TlsClient(conn, t.TlsConf, addr); err != nil {
+			return nil, err
+		}
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// proxyDestination 经由上游代理时连接的对端为代理，PROXY协议头的目的地址使用后端地址，域名按dns配置解析
+func proxyDestination(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if ips, err := LookupIP(ctx, host); err == nil && len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port)
+	}
+	return addr
+}
+
+// SplitAddr 解析内网地址，unix:///path/to.sock 使用Unix域套接字
+func SplitAddr(network, addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix://") {
+		if strings.HasPrefix(network, "udp") {
+			return "unixgram", strings.TrimPrefix(addr, "unix://")
+		}
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	return network, addr
+}
+
+// dialer 内网目标的拨号器
+func (t *TargetHandler) dialer(timeout time.Duration) NetDialer {
+	return NetDialer{
+		LocalAddr: t.Conf.LocalAddress,
+		Interface: t.Conf.Interface,
+		Socket:    SocketOptions(conf.AppConf().Natok.Socket, t.Conf.Socket),
+		Timeout:   timeout,
+	}
+}
+
+// dialAddr 连接内网地址，域名按dns配置解析
+func dialAddr(network, addr string, dialer NetDialer) (net.Conn, error) {
+	network, addr = SplitAddr(network, addr)
+	if strings.HasPrefix(network, "unix") {
+		return net.DialTimeout(network, addr, dialer.Timeout)
+	}
+	return dialer.Dial(network, addr)
+}
+
+// DialReason 连接失败原因，上报至natok-server
+func DialReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTargetDenied):
+		return "denied"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not found"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return err.Error()
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"natok-cli/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenTcp 本地TCP服务，返回地址与已接受连接的通知
+func listenTcp(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func TestTargetTlsFailClosed(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	err := InitTargets([]conf.Target{{Addr: addr, Tls: &conf.TlsConf{CaPath: "/nonexistent/ca.pem"}}})
+	defer func() { _ = InitTargets(nil) }()
+	if err == nil {
+		t.Fatal("expected tls config error")
+	}
+	if conn, err := DialIntra("tcp", addr, "203.0.113.1:1000", nil); err == nil {
+		_ = conn.Close()
+		t.Fatal("target with broken tls config must not be dialed")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("plaintext connection reached the target")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
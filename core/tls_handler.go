@@ -0,0 +1,62 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"natok-cli/conf"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout 内网TLS握手超时，内网服务接受连接但不响应握手时不无限阻塞
+var tlsHandshakeTimeout = 10 * time.Second
+
+// IntraTlsConfig 构建连接内网服务的TLS配置
+func IntraTlsConfig(cfg *conf.TlsConf) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CaPath != "" {
+		caBytes, err := os.ReadFile(cfg.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("failed to parse ca certificate " + cfg.CaPath)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if cfg.CertPemPath != "" || cfg.CertKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertPemPath, cfg.CertKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// TlsClient 以TLS包装内网连接，未指定SNI时使用内网地址的主机名
+func TlsClient(conn net.Conn, tlsConf *tls.Config, addr string) (net.Conn, error) {
+	if tlsConf.ServerName == "" {
+		tlsConf = tlsConf.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConf.ServerName = host
+		} else {
+			tlsConf.ServerName = "localhost"
+		}
+	}
+	client := tls.Client(conn, tlsConf)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := client.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
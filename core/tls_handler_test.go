@@ -0,0 +1,52 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestTlsClientHandshakeTimeout(t *testing.T) {
+	addr, accepted := listenTcp(t)
+	defaultTimeout := tlsHandshakeTimeout
+	tlsHandshakeTimeout = 200 * time.Millisecond
+	defer func() { tlsHandshakeTimeout = defaultTimeout }()
+	target := &TargetHandler{TlsConf: &tls.Config{InsecureSkipVerify: true}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := target.Dial("tcp", addr, "")
+		done <- err
+	}()
+	// 内网服务接受连接但不响应握手
+	backend := <-accepted
+	defer func() { _ = backend.Close() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("handshake without a server reply succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestTlsClientServerName(t *testing.T) {
+	cert := selfSigned(t, "natok.test")
+	addr, accepted := listenTcp(t)
+	go func() {
+		backend := <-accepted
+		server := tls.Server(backend, &tls.Config{Certificates: []tls.Certificate{cert}})
+		_ = server.Handshake()
+		_ = server.Close()
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	// 未指定SNI时使用内网地址的主机名校验证书
+	target := &TargetHandler{TlsConf: &tls.Config{RootCAs: roots}}
+	conn, err := target.Dial("tcp", addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
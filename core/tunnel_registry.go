@@ -0,0 +1,281 @@
+package core
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道状态
+const (
+	TunnelStateConnecting = "connecting" // 建立natok数据连接
+	TunnelStateDialing    = "dialing"    // 连接内网服务
+	TunnelStateOpen       = "open"       // 转发中
+	TunnelStateClosed     = "closed"     // 已关闭
+)
+
+// 隧道关闭原因
+const (
+	CloseReasonPeer       = "peer_close"        // 公网来源或内网服务关闭
+	CloseReasonDialFailed = "dial_failed"       // 连接内网服务失败
+	CloseReasonServer     = "server_disconnect" // 与natok-server的数据连接断开
+	CloseReasonDenied     = "policy_deny"       // 连接前拒绝：内网目标已停用或无健康后端
+	CloseReasonKilled     = "killed"            // 经管理接口关闭
+)
+
+// Tunnel struct 隧道，由natok-server下发的序列标识
+type Tunnel struct {
+	mu       sync.Mutex
+	Serial   string    //隧道序列
+	Server   string    //natok-server地址
+	Start    time.Time //开始时间
+	network  string    //网络类型
+	source   string    //公网来源
+	target   string    //内网目标
+	state    string    //状态
+	kill     func()    //关闭隧道
+	reason   string    //关闭原因
+	err      string    //连接失败原因
+	bytesIn  int64     //发往内网的字节
+	bytesOut int64     //发往natok-server的字节
+}
+
+// TunnelInfo struct 隧道信息
+type TunnelInfo struct {
+	Serial   string    `json:"serial"`
+	Server   string    `json:"server"`
+	State    string    `json:"state"`
+	Network  string    `json:"network"`
+	Source   string    `json:"source"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	Age      string    `json:"age"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// tunnelKey struct 隧道序列仅在同一natok-server内唯一
+type tunnelKey struct {
+	server string
+	serial string
+}
+
+var (
+	tunnelMu sync.RWMutex
+	tunnels  = make(map[tunnelKey]*Tunnel) //存活的隧道
+)
+
+// NewTunnel 登记隧道，kill用于主动关闭；相同序列的旧隧道将被注销
+func NewTunnel(server, serial string, kill func()) *Tunnel {
+	t := &Tunnel{Serial: serial, Server: server, Start: time.Now(), state: TunnelStateConnecting, kill: kill}
+	key := tunnelKey{server, serial}
+	tunnelMu.Lock()
+	old := tunnels[key]
+	tunnels[key] = t
+	tunnelMu.Unlock()
+	old.Remove()
+	return t
+}
+
+// FindTunnel 按序列查找隧道
+func FindTunnel(server, serial string) *Tunnel {
+	tunnelMu.RLock()
+	defer tunnelMu.RUnlock()
+	return tunnels[tunnelKey{server, serial}]
+}
+
+// Dial 开始连接内网服务
+func (t *Tunnel) Dial(network, source, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.network, t.source, t.target = network, source, network+"://"+addr
+	t.state = TunnelStateDialing
+}
+
+// Open 内网服务已连接，kill用于主动关闭
+func (t *Tunnel) Open(kill func()) {
+	t.mu.Lock()
+	t.state, t.kill = TunnelStateOpen, kill
+	t.mu.Unlock()
+	TunnelOpened(t.Server, t.Target())
+}
+
+// Fail 连接内网服务失败，监控指标记录归类的原因，访问日志记录完整错误
+func (t *Tunnel) Fail(err error) {
+	TunnelFailed(t.Server, t.Target(), DialReason(err))
+	t.mu.Lock()
+	t.err = err.Error()
+	t.mu.Unlock()
+	if errors.Is(err, ErrTargetDenied) {
+		t.Closing(CloseReasonDenied)
+	} else {
+		t.Closing(CloseReasonDialFailed)
+	}
+	t.Remove()
+}
+
+// Closing 记录关闭原因，以最先记录的为准
+func (t *Tunnel) Closing(reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+}
+
+// Remove 注销隧道，连接过内网服务的隧道写入访问日志
+func (t *Tunnel) Remove() {
+	if t == nil {
+		return
+	}
+	key := tunnelKey{t.Server, t.Serial}
+	tunnelMu.Lock()
+	if tunnels[key] == t {
+		delete(tunnels, key)
+	}
+	tunnelMu.Unlock()
+	t.mu.Lock()
+	state := t.state
+	t.state = TunnelStateClosed
+	if t.reason == "" {
+		t.reason = CloseReasonPeer
+	}
+	t.mu.Unlock()
+	if state == TunnelStateOpen {
+		TunnelClosed(t.Server, t.Target())
+	}
+	if state == TunnelStateDialing || state == TunnelStateOpen {
+		WriteAccess(t.access())
+	}
+}
+
+// access 访问日志
+func (t *Tunnel) access() AccessEntry {
+	end := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return AccessEntry{
+		Serial:   t.Serial,
+		Server:   t.Server,
+		Network:  t.network,
+		Source:   t.source,
+		Target:   t.target,
+		Start:    t.Start,
+		End:      end,
+		Duration: end.Sub(t.Start).Seconds(),
+		BytesIn:  atomic.LoadInt64(&t.bytesIn),
+		BytesOut: atomic.LoadInt64(&t.bytesOut),
+		Reason:   t.reason,
+		Error:    t.err,
+	}
+}
+
+// Kill 主动关闭隧道
+func (t *Tunnel) Kill() {
+	t.Closing(CloseReasonKilled)
+	t.mu.Lock()
+	kill := t.kill
+	t.mu.Unlock()
+	if kill != nil {
+		kill()
+	}
+}
+
+// Target 内网目标
+func (t *Tunnel) Target() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.target
+}
+
+// In 统计发往内网的字节
+func (t *Tunnel) In(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&t.bytesIn, int64(n))
+	CountBytes(t.Target(), "in", n)
+}
+
+// Out 统计发往natok-server的字节
+func (t *Tunnel) Out(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&t.bytesOut, int64(n))
+	CountBytes(t.Target(), "out", n)
+}
+
+// Logger 日志，附带natok-server、隧道序列与内网目标
+func (t *Tunnel) Logger() *log.Entry {
+	if t == nil {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return log.WithFields(log.Fields{"server": t.Server, "serial": t.Serial, "target": t.Target()})
+}
+
+// Info 隧道信息
+func (t *Tunnel) Info() TunnelInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TunnelInfo{
+		Serial:   t.Serial,
+		Server:   t.Server,
+		State:    t.state,
+		Network:  t.network,
+		Source:   t.source,
+		Target:   t.target,
+		Start:    t.Start,
+		Age:      time.Since(t.Start).Round(time.Second).String(),
+		BytesIn:  atomic.LoadInt64(&t.bytesIn),
+		BytesOut: atomic.LoadInt64(&t.bytesOut),
+	}
+}
+
+// Tunnels 存活的隧道，按开始时间排序
+func Tunnels() []TunnelInfo {
+	tunnelMu.RLock()
+	list := make([]TunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		list = append(list, t.Info())
+	}
+	tunnelMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// KillTunnel 按序列关闭隧道，server为空时匹配全部natok-server，返回关闭的数量
+func KillTunnel(serial, server string) int {
+	var list []*Tunnel
+	tunnelMu.RLock()
+	for key, t := range tunnels {
+		if key.serial == serial && (server == "" || key.server == server) {
+			list = append(list, t)
+		}
+	}
+	tunnelMu.RUnlock()
+	for _, t := range list {
+		t.Kill()
+	}
+	return len(list)
+}
+
+// Drain 等待存活的隧道关闭，超时返回剩余数量
+func Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		tunnelMu.RLock()
+		count := len(tunnels)
+		tunnelMu.RUnlock()
+		if count == 0 || time.Now().After(deadline) {
+			return count
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
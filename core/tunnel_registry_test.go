@@ -0,0 +1,61 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"natok-cli/conf"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// failEntry 隧道连接失败后写入的访问日志
+func failEntry(t *testing.T, network, target string, err error) AccessEntry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.log")
+	InitAccessLog(&conf.AccessLogConf{Path: path})
+	defer InitAccessLog(nil)
+	tunnel := NewTunnel("natok.test:1001", "42", nil)
+	tunnel.Dial(network, "203.0.113.1:1000", target)
+	tunnel.Fail(err)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry AccessEntry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestTunnelFailPermission(t *testing.T) {
+	// 权限不足是内网目标的连接错误，而非访问策略拒绝
+	entry := failEntry(t, "unix", "/run/app.sock", fmt.Errorf("dial unix /run/app.sock: %w", fs.ErrPermission))
+	if entry.Reason != CloseReasonDialFailed || entry.Error != "dial unix /run/app.sock: permission denied" {
+		t.Fatalf("unexpected access entry: %+v", entry)
+	}
+}
+
+func TestTunnelFailDenied(t *testing.T) {
+	// 无健康后端时未发起连接即拒绝
+	target := &TargetHandler{Conf: conf.Target{Addr: "127.0.0.1:8080"}, Backends: []*Backend{{Addr: "127.0.0.1:8081"}}}
+	_, err := target.Pick()
+	if entry := failEntry(t, "tcp", "127.0.0.1:8080", err); entry.Reason != CloseReasonDenied || entry.Error != err.Error() {
+		t.Fatalf("unexpected access entry: %+v", entry)
+	}
+	// 配置出错停用的内网目标
+	target = &TargetHandler{Conf: conf.Target{Addr: "127.0.0.1:8080"}}
+	target.fail(errors.New("proxy config failed"))
+	_, err = target.Pick()
+	if entry := failEntry(t, "tcp", "127.0.0.1:8080", err); entry.Reason != CloseReasonDenied || DialReason(err) != "denied" {
+		t.Fatalf("unexpected access entry: %+v", entry)
+	}
+	// 连接被拒绝仍为连接失败
+	if entry := failEntry(t, "tcp", "127.0.0.1:8080", fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)); entry.Reason != CloseReasonDialFailed {
+		t.Fatalf("unexpected access entry: %+v", entry)
+	}
+}
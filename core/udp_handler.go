@@ -0,0 +1,303 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"natok-cli/conf"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP默认配置
+const (
+	UdpIdleTimeout     = 60    // 会话空闲超时60秒
+	UdpMaxDatagramSize = 65507 // 最大数据报大小
+)
+
+var errDatagramFrame = errors.New("invalid udp datagram frame")
+
+// Datagram struct UDP数据报帧：[1字节来源长度][来源地址][2字节数据长度][数据]
+type Datagram struct {
+	Peer string //公网来源
+	Data []byte //数据报
+}
+
+// EncodeDatagram 编码数据报帧
+func EncodeDatagram(peer string, data []byte) []byte {
+	frame := make([]byte, 0, Uint8Size+len(peer)+Uint16Size+len(data))
+	frame = append(frame, byte(len(peer)))
+	frame = append(frame, peer...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	return append(frame, data...)
+}
+
+// DecodeDatagrams 解码数据报帧，一条消息可包含多个数据报
+func DecodeDatagrams(buf []byte) ([]Datagram, error) {
+	var list []Datagram
+	for len(buf) > 0 {
+		peerLen := int(buf[0])
+		if len(buf) < Uint8Size+peerLen+Uint16Size {
+			return list, errDatagramFrame
+		}
+		peer := string(buf[Uint8Size : Uint8Size+peerLen])
+		buf = buf[Uint8Size+peerLen:]
+		dataLen := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < Uint16Size+dataLen {
+			return list, errDatagramFrame
+		}
+		list = append(list, Datagram{Peer: peer, Data: buf[Uint16Size : Uint16Size+dataLen]})
+		buf = buf[Uint16Size+dataLen:]
+	}
+	return list, nil
+}
+
+// UdpSession struct UDP会话，每个公网来源对应一个内网连接
+type UdpSession struct {
+	Peer   string    //公网来源
+	Conn   net.Conn  //内网连接
+	Active time.Time //最近活跃
+}
+
+// UdpHandler struct UDP隧道处理，按公网来源维护会话表
+type UdpHandler struct {
+	mu          sync.Mutex
+	Network     string                 //网络类型
+	Addr        string                 //内网地址
+	Serial      string                 //隧道序列
+	Source      string                 //公网来源，未使用数据报帧时的会话标识
+	Framed      bool                   //是否使用数据报帧
+	Idle        time.Duration          //空闲超时
+	MaxSize     int                    //最大数据报
+	Sessions    map[string]*UdpSession //会话表
+	ConnHandler *ConnectHandler        //natok连接
+	tunnel      *Tunnel                //隧道登记
+	closed      bool
+}
+
+// NewUdpHandler 创建UDP隧道处理
+func NewUdpHandler(network, addr, serial, source string, framed bool, connHandler *ConnectHandler) *UdpHandler {
+	cfg := conf.AppConf().Natok.Udp
+	if target := FindTarget(addr); target != nil && target.Conf.Udp != nil {
+		cfg = *target.Conf.Udp
+	}
+	u := &UdpHandler{
+		Network:     network,
+		Addr:        addr,
+		Serial:      serial,
+		Source:      source,
+		Framed:      framed,
+		Idle:        time.Duration(cfg.IdleTimeout) * time.Second,
+		MaxSize:     cfg.MaxDatagramSize,
+		Sessions:    make(map[string]*UdpSession),
+		ConnHandler: connHandler,
+	}
+	if u.Idle <= 0 {
+		u.Idle = UdpIdleTimeout * time.Second
+	}
+	if u.MaxSize <= 0 || u.MaxSize > UdpMaxDatagramSize {
+		u.MaxSize = UdpMaxDatagramSize
+	}
+	go u.expire()
+	return u
+}
+
+// Session 获取或创建会话
+func (u *UdpHandler) Session(peer string) (*UdpSession, error) {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if session, ok := u.Sessions[peer]; ok {
+		session.Active = time.Now()
+		u.mu.Unlock()
+		return session, nil
+	}
+	tunnel := u.tunnel
+	u.mu.Unlock()
+	// 连接内网服务时不持有锁，不阻塞其它会话的收发
+	conn, err := DialIntra(u.Network, u.Addr, peer, tunnel)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+	// 连接期间同一来源的会话已创建，关闭多余的连接
+	if session, ok := u.Sessions[peer]; ok {
+		session.Active = time.Now()
+		u.mu.Unlock()
+		_ = conn.Close()
+		return session, nil
+	}
+	session := &UdpSession{Peer: peer, Conn: conn, Active: time.Now()}
+	u.Sessions[peer] = session
+	tunnel = u.tunnel
+	u.mu.Unlock()
+	go u.read(session)
+	// 隧道登记前为空，日志不附带隧道信息
+	tunnel.Logger().Debugf("Udp session open %s -> %s://%s", peer, u.Network, u.Addr)
+	return session, nil
+}
+
+// Transfer 转发来自natok-server的数据报
+func (u *UdpHandler) Transfer(data []byte) {
+	if !u.Framed {
+		u.send(Datagram{Peer: u.Source, Data: data})
+		return
+	}
+	list, err := DecodeDatagrams(data)
+	if err != nil {
+		u.Tunnel().Logger().Warnf("Udp tunnel dropped malformed frame, Error: %+v", err)
+	}
+	for _, datagram := range list {
+		u.send(datagram)
+	}
+}
+
+// send 发送数据报至内网服务
+func (u *UdpHandler) send(datagram Datagram) {
+	if len(datagram.Data) > u.MaxSize {
+		u.drop("in", len(datagram.Data), datagram.Peer)
+		return
+	}
+	session, err := u.Session(datagram.Peer)
+	if err != nil {
+		u.Tunnel().Logger().Warnf("Udp tunnel connect intranet failed, Peer: %s, Error: %+v", datagram.Peer, err)
+		return
+	}
+	n, _ := session.Conn.Write(datagram.Data)
+	u.Tunnel().In(n)
+}
+
+// Tunnel 隧道登记
+func (u *UdpHandler) Tunnel() *Tunnel {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.tunnel
+}
+
+// drop 丢弃超出大小的数据报，direction为in或out
+func (u *UdpHandler) drop(direction string, size int, peer string) {
+	Metrics.Add(MetricUdpDropped, 1, "target", u.Network+"://"+u.Addr, "direction", direction)
+	u.Tunnel().Logger().Debugf("Udp tunnel dropped datagram of %d bytes, Peer: %s, Direction: %s", size, peer, direction)
+}
+
+// read 读取内网服务的数据报并转发至natok-server
+func (u *UdpHandler) read(session *UdpSession) {
+	// 多读一个字节以识别超出大小的数据报
+	buf := make([]byte, u.MaxSize+1)
+	for {
+		n, err := session.Conn.Read(buf)
+		if err != nil {
+			u.remove(session, err)
+			return
+		}
+		u.mu.Lock()
+		session.Active = time.Now()
+		u.mu.Unlock()
+		if n > u.MaxSize {
+			u.drop("out", n, session.Peer)
+			continue
+		}
+		u.Tunnel().Out(n)
+		data := buf[:n]
+		if u.Framed {
+			data = EncodeDatagram(session.Peer, data)
+		} else {
+			data = append([]byte(nil), data...)
+		}
+		u.ConnHandler.Write(Message{Type: TypeTransfer, Serial: u.Serial, Data: data})
+	}
+}
+
+// remove 移除会话，未使用数据报帧时隧道随会话关闭
+func (u *UdpHandler) remove(session *UdpSession, reason error) {
+	u.mu.Lock()
+	if u.Sessions[session.Peer] == session {
+		delete(u.Sessions, session.Peer)
+	}
+	closed := u.closed
+	u.mu.Unlock()
+	_ = session.Conn.Close()
+	u.Tunnel().Logger().Debugf("Udp session close %s, Reason: %v", session.Peer, reason)
+	if !u.Framed && !closed {
+		u.Close()
+		u.ConnHandler.Write(DisconnectMessage(u.Serial, u.Source, ""))
+	}
+}
+
+// expire 回收空闲会话
+func (u *UdpHandler) expire() {
+	ticker := time.NewTicker(u.Idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.mu.Lock()
+		if u.closed {
+			u.mu.Unlock()
+			return
+		}
+		var idle []*UdpSession
+		for _, session := range u.Sessions {
+			if time.Since(session.Active) >= u.Idle {
+				idle = append(idle, session)
+			}
+		}
+		u.mu.Unlock()
+		for _, session := range idle {
+			// 关闭后由read移除会话
+			_ = session.Conn.Close()
+			u.Tunnel().Logger().Debugf("Udp session idle %s, Timeout: %s", session.Peer, u.Idle)
+		}
+	}
+}
+
+// Close 关闭全部会话
+func (u *UdpHandler) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return
+	}
+	u.closed = true
+	for peer, session := range u.Sessions {
+		_ = session.Conn.Close()
+		delete(u.Sessions, peer)
+	}
+	u.tunnel.Remove()
+}
+
+// connectUdp 建立UDP隧道
+func (s *NatokServerHandler) connectUdp(connHandler *ConnectHandler, msg Message, tunnel *Tunnel) {
+	framed := s.NatokHandler != nil && s.NatokHandler.Features.Has(FeatureUdpFrame)
+	udp := NewUdpHandler(msg.Net, string(msg.Data), msg.Serial, msg.Uri, framed, connHandler)
+	// 未使用数据报帧时仅有一个会话，立即连接以便及时反馈失败
+	if !framed {
+		if _, err := udp.Session(msg.Uri); err != nil {
+			udp.Close()
+			tunnel.Logger().Errorf("2-e =====Connect intranet server failed, Source: %s, Error: %+v", msg.Uri, err)
+			tunnel.Fail(err)
+			connHandler.Write(DisconnectMessage(msg.Serial, msg.Uri, DialReason(err)))
+			return
+		}
+	}
+	tunnel.Open(func() {
+		udp.Close()
+		connHandler.Write(DisconnectMessage(msg.Serial, msg.Uri, ""))
+	})
+	udp.mu.Lock()
+	udp.tunnel = tunnel
+	closed := udp.closed
+	udp.mu.Unlock()
+	// 登记前会话已关闭
+	if closed {
+		tunnel.Remove()
+	}
+	s.udp.Store(udp)
+	connHandler.Write(Message{Type: TypeConnectIntra, Serial: msg.Serial, Uri: s.AccessKey})
+	tunnel.Logger().Debugf("2-2 =====Connect intranet udp, Framed: %v", framed)
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpEcho 本地UDP回显服务，回复两份相同数据以便构造超出大小的数据报
+func udpEcho(t *testing.T, repeat int) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(bytes.Repeat(buf[:n], repeat), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// udpPipe natok数据连接，返回收到的消息
+func udpPipe(t *testing.T) (*ConnectHandler, <-chan Message) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { _ = local.Close(); _ = remote.Close() })
+	handler := &NatokServerHandler{}
+	messages := make(chan Message, 16)
+	go func() {
+		var buf []byte
+		chunk := make([]byte, 65535)
+		for {
+			n, err := remote.Read(chunk)
+			if err != nil {
+				return
+			}
+			buf = append(buf, chunk[:n]...)
+			for len(buf) >= Uint32Size {
+				msg, size := handler.Decode(buf)
+				if msg == nil {
+					break
+				}
+				messages <- msg.(Message)
+				buf = buf[size:]
+			}
+		}
+	}()
+	return &ConnectHandler{Conn: local, MsgHandler: handler}, messages
+}
+
+// receive 等待一条消息
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message from udp tunnel")
+		return Message{}
+	}
+}
+
+func TestUdpTunnelEcho(t *testing.T) {
+	addr := udpEcho(t, 1)
+	connHandler, messages := udpPipe(t)
+	udp := NewUdpHandler("udp", addr, "7", "203.0.113.7:5000", false, connHandler)
+	defer udp.Close()
+
+	udp.Transfer([]byte("ping"))
+	msg := receive(t, messages)
+	if msg.Type != TypeTransfer || msg.Serial != "7" || string(msg.Data) != "ping" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestUdpTunnelFramed(t *testing.T) {
+	addr := udpEcho(t, 1)
+	connHandler, messages := udpPipe(t)
+	udp := NewUdpHandler("udp", addr, "8", "", true, connHandler)
+	defer udp.Close()
+
+	frame := append(EncodeDatagram("198.51.100.1:1000", []byte("one")), EncodeDatagram("198.51.100.2:2000", []byte("two"))...)
+	udp.Transfer(frame)
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		list, err := DecodeDatagrams(receive(t, messages).Data)
+		if err != nil || len(list) != 1 {
+			t.Fatalf("decode reply: %v %v", list, err)
+		}
+		got[list[0].Peer] = string(list[0].Data)
+	}
+	if got["198.51.100.1:1000"] != "one" || got["198.51.100.2:2000"] != "two" {
+		t.Fatalf("replies routed to wrong peers: %v", got)
+	}
+	udp.mu.Lock()
+	sessions := len(udp.Sessions)
+	udp.mu.Unlock()
+	if sessions != 2 {
+		t.Fatalf("expected a session per peer, got %d", sessions)
+	}
+}
+
+func TestUdpTunnelOversize(t *testing.T) {
+	addr := udpEcho(t, 2)
+	connHandler, messages := udpPipe(t)
+	udp := NewUdpHandler("udp", addr, "9", "203.0.113.9:5000", false, connHandler)
+	udp.MaxSize = 6
+	defer udp.Close()
+
+	target := "udp://" + addr
+	Metrics.mu.Lock()
+	before := Metrics.values[MetricUdpDropped][labels("target", target, "direction", "out")]
+	Metrics.mu.Unlock()
+	// 回复为8字节，超出上限被丢弃而非截断
+	udp.Transfer([]byte("four"))
+	// 发往内网的超长数据报同样被丢弃
+	udp.Transfer([]byte("seven77"))
+	// 回复为6字节，正常转发
+	udp.Transfer([]byte("abc"))
+	msg := receive(t, messages)
+	if string(msg.Data) != "abcabc" {
+		t.Fatalf("expected only the fitting reply, got %q", msg.Data)
+	}
+	Metrics.mu.Lock()
+	out := Metrics.values[MetricUdpDropped][labels("target", target, "direction", "out")]
+	in := Metrics.values[MetricUdpDropped][labels("target", target, "direction", "in")]
+	Metrics.mu.Unlock()
+	if out-before != 1 || in != 1 {
+		t.Fatalf("dropped datagrams not counted: out %v in %v", out-before, in)
+	}
+}
+
+func TestUdpSessionConcurrent(t *testing.T) {
+	addr := udpEcho(t, 1)
+	connHandler, _ := udpPipe(t)
+	udp := NewUdpHandler("udp", addr, "10", "", true, connHandler)
+	defer udp.Close()
+
+	// 同一来源并发创建会话，仅保留一个会话
+	sessions := make(chan *UdpSession, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(sessions); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := udp.Session("198.51.100.1:1000")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sessions <- session
+		}()
+	}
+	wg.Wait()
+	close(sessions)
+	first := <-sessions
+	for session := range sessions {
+		if session != first {
+			t.Fatal("concurrent sessions for the same peer differ")
+		}
+	}
+	udp.mu.Lock()
+	count := len(udp.Sessions)
+	udp.mu.Unlock()
+	if count != 1 {
+		t.Fatalf("expected one session, got %d", count)
+	}
+	udp.Close()
+	if _, err := udp.Session("198.51.100.2:2000"); err != net.ErrClosed {
+		t.Fatalf("session after close: %v", err)
+	}
+}
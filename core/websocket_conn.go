@@ -0,0 +1,232 @@
+package core
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// WebSocket操作码
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+	wsGuid           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxControl     = 125 // 控制帧最大负载
+)
+
+var (
+	errWsProtocol = errors.New("websocket: protocol error")
+	errWsTooLarge = errors.New("websocket: frame too large")
+)
+
+// WsConn struct WebSocket客户端连接，以二进制帧承载natok数据流
+type WsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	wmu     sync.Mutex
+	remain  uint64 //当前帧剩余长度
+	mask    []byte //当前帧掩码
+	offset  int    //掩码偏移
+	closing bool   //已发送关闭帧
+}
+
+// WsHandshake WebSocket握手
+func WsHandshake(conn net.Conn, wsUrl *url.URL, origin string, headers map[string]string) (*WsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: wsUrl.Path, RawQuery: wsUrl.RawQuery},
+		Host:       wsUrl.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("websocket handshake failed: " + resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + wsGuid))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("websocket handshake failed: invalid accept key")
+	}
+	return &WsConn{Conn: conn, reader: reader}, nil
+}
+
+// Read 读取数据帧内容，自动应答ping与close
+func (c *WsConn) Read(b []byte) (int, error) {
+	for c.remain == 0 {
+		opcode, size, mask, err := c.readHeader()
+		if err != nil {
+			if err == errWsProtocol || err == errWsTooLarge {
+				// 1002协议错误，1009帧过大
+				code := []byte{0x03, 0xea}
+				if err == errWsTooLarge {
+					code[1] = 0xf1
+				}
+				_ = c.writeFrame(wsOpClose, code)
+			}
+			return 0, err
+		}
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.remain, c.mask, c.offset = size, mask, 0
+		case wsOpPing, wsOpPong, wsOpClose:
+			payload := make([]byte, size)
+			if _, err = io.ReadFull(c.reader, payload); err != nil {
+				return 0, err
+			}
+			unmask(payload, mask, 0)
+			if opcode == wsOpPing {
+				_ = c.writeFrame(wsOpPong, payload)
+			} else if opcode == wsOpClose {
+				_ = c.writeFrame(wsOpClose, payload)
+				return 0, io.EOF
+			}
+		default:
+			return 0, errors.New("websocket: unknown opcode")
+		}
+	}
+	if uint64(len(b)) > c.remain {
+		b = b[:c.remain]
+	}
+	n, err := c.reader.Read(b)
+	unmask(b[:n], c.mask, c.offset)
+	c.offset += n
+	c.remain -= uint64(n)
+	return n, err
+}
+
+// readHeader 读取帧头，分配负载前校验长度：控制帧不得分片且不超过125字节，数据帧不超过最大数据包
+func (c *WsConn) readHeader() (byte, uint64, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return 0, 0, nil, err
+	}
+	opcode := head[0] & 0x0f
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if opcode >= wsOpClose {
+		if head[0]&0x80 == 0 || size > wsMaxControl {
+			return 0, 0, nil, errWsProtocol
+		}
+	} else if size > MaxPacketSize {
+		return 0, 0, nil, errWsTooLarge
+	}
+	var mask []byte
+	if head[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return opcode, size, mask, nil
+}
+
+// Write 以二进制帧写入
+func (c *WsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close 发送关闭帧并关闭连接
+func (c *WsConn) Close() error {
+	_ = c.writeFrame(wsOpClose, []byte{0x03, 0xe8})
+	return c.Conn.Close()
+}
+
+// writeFrame 写入客户端帧，客户端帧须使用掩码
+func (c *WsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return net.ErrClosed
+	}
+	if opcode == wsOpClose {
+		c.closing = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, 0x80|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	unmask(frame[start:], mask, 0)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// unmask 按掩码异或，offset为帧内偏移
+func unmask(data, mask []byte, offset int) {
+	if mask == nil {
+		return
+	}
+	for i := range data {
+		data[i] ^= mask[(offset+i)%4]
+	}
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"natok-cli/conf"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// selfSigned 自签名证书
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// wsRequest WebSocket服务端收到的握手
+type wsRequest struct {
+	path   string
+	header http.Header
+	certs  int
+}
+
+// wsStandIn 本地WebSocket服务，回显二进制帧；tlsConf不为空时为wss
+func wsStandIn(t *testing.T, tlsConf *tls.Config) (string, <-chan wsRequest) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	requests := make(chan wsRequest, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				certs := 0
+				if tlsConf != nil {
+					tlsConn := tls.Server(conn, tlsConf)
+					if tlsConn.Handshake() != nil {
+						return
+					}
+					certs = len(tlsConn.ConnectionState().PeerCertificates)
+					conn = tlsConn
+				}
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				requests <- wsRequest{path: req.URL.Path, header: req.Header, certs: certs}
+				sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + wsGuid))
+				_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"))
+				// 服务端帧不使用掩码，先发送ping
+				_, _ = conn.Write([]byte{0x80 | wsOpPing, 2, 'h', 'i'})
+				server := &WsConn{Conn: conn, reader: reader}
+				buf := make([]byte, 1024)
+				for {
+					opcode, size, mask, err := server.readHeader()
+					if err != nil {
+						return
+					}
+					payload := buf[:size]
+					if _, err = io.ReadFull(server.reader, payload); err != nil {
+						return
+					}
+					unmask(payload, mask, 0)
+					if mask == nil {
+						return
+					}
+					switch opcode {
+					case wsOpBinary:
+						_, _ = conn.Write(append([]byte{0x80 | wsOpBinary, byte(size)}, payload...))
+					case wsOpPong:
+						_, _ = conn.Write(append([]byte{0x80 | wsOpBinary, byte(size + 5)}, append([]byte("pong:"), payload...)...))
+					case wsOpClose:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+// wsExpect 读取一段数据
+func wsExpect(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(want))
+	for read := 0; read < len(want); {
+		n, err := conn.Read(buf[read:])
+		if err != nil {
+			t.Fatalf("read %q: %v", want, err)
+		}
+		read += n
+	}
+	if string(buf) != want {
+		t.Fatalf("got %q, want %q", buf, want)
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	addr, requests := wsStandIn(t, nil)
+	natok := &NatokConnConfig{Addr: addr, WebSocket: &conf.WebSocket{Scheme: "ws", Path: "/natok", Headers: map[string]string{"X-Token": "abc"}}}
+	conn, err := natok.Dial(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	req := <-requests
+	if req.path != "/natok" || req.header.Get("X-Token") != "abc" || req.header.Get("Upgrade") != "websocket" {
+		t.Fatalf("unexpected handshake: %+v", req)
+	}
+	if _, err = conn.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	// 读取时自动应答ping，服务端回显pong
+	wsExpect(t, conn, "datapong:hi")
+}
+
+func TestWebSocketTlsClientCert(t *testing.T) {
+	serverCert := selfSigned(t, "natok.test")
+	clientCert := selfSigned(t, "natok-cli")
+	addr, requests := wsStandIn(t, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert})
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	natok := &NatokConnConfig{
+		Addr:      addr,
+		Conf:      &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: roots, ServerName: "natok.test"},
+		WebSocket: &conf.WebSocket{},
+	}
+	conn, err := natok.Dial(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if req := <-requests; req.certs != 1 {
+		t.Fatalf("natok client certificate was not presented over wss, got %d", req.certs)
+	}
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	wsExpect(t, conn, "xpong:hi")
+}
+
+func TestWebSocketFrameLimits(t *testing.T) {
+	huge := []byte{127, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	cases := []struct {
+		name  string
+		frame []byte
+		err   error
+		code  byte
+	}{
+		{"oversized ping", append([]byte{0x80 | wsOpPing}, huge...), errWsProtocol, 0xea},
+		{"ping over 125", []byte{0x80 | wsOpPing, 126, 0x00, 126}, errWsProtocol, 0xea},
+		{"fragmented close", []byte{wsOpClose, 0}, errWsProtocol, 0xea},
+		{"oversized binary", append([]byte{0x80 | wsOpBinary}, huge...), errWsTooLarge, 0xf1},
+	}
+	for _, item := range cases {
+		server, client := net.Pipe()
+		conn := &WsConn{Conn: client, reader: bufio.NewReader(client)}
+		replies := make(chan []byte, 1)
+		go func() {
+			_, _ = server.Write(item.frame)
+			reply, _ := io.ReadAll(server)
+			replies <- reply
+		}()
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 16)); err != item.err {
+			t.Fatalf("%s: %v, want %v", item.name, err, item.err)
+		}
+		_ = client.Close()
+		// 回复带掩码的关闭帧，状态码位于掩码后
+		reply := <-replies
+		if len(reply) != 8 || reply[0] != 0x80|wsOpClose || reply[7]^reply[3] != item.code {
+			t.Fatalf("%s: close frame % x", item.name, reply)
+		}
+		_ = server.Close()
+	}
+}
+
+func TestWebSocketPing(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = server.Close(); _ = client.Close() }()
+	conn := &WsConn{Conn: client, reader: bufio.NewReader(client)}
+	go func() {
+		// ping之后为数据帧
+		_, _ = server.Write([]byte{0x80 | wsOpPing, 2, 'h', 'i', 0x80 | wsOpBinary, 4, 'd', 'a', 't', 'a'})
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		frame := make([]byte, 8)
+		_, _ = io.ReadFull(server, frame)
+		pong <- frame
+	}()
+	wsExpect(t, conn, "data")
+	frame := <-pong
+	if frame[0] != 0x80|wsOpPong || frame[1] != 0x80|2 || frame[6]^frame[2] != 'h' || frame[7]^frame[3] != 'i' {
+		t.Fatalf("pong frame % x", frame)
+	}
+}
@@ -1,11 +1,16 @@
 module natok-cli
 
-go 1.19
+go 1.24
 
 require (
 	github.com/kardianos/service v1.2.2
+	github.com/quic-go/quic-go v0.59.1
 	github.com/sirupsen/logrus v1.9.3
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+require (
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
@@ -27,6 +27,17 @@ func (p *Program) run() {
 
 func (p *Program) Stop(s service.Service) error {
 	log.Info("Stop natok client service")
+	// 暂停全部natok-server，不再接受新的隧道，等待存活的隧道关闭
+	for _, handler := range core.NatokServers() {
+		handler.Pause()
+	}
+	timeout := time.Duration(conf.AppConf().Natok.DrainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	if count := core.Drain(timeout); count > 0 {
+		log.Warnf("Stop with %d tunnels still open", count)
+	}
 	return nil
 }
 
@@ -38,6 +49,12 @@ func main() {
 		Description: "Go语言实现的内网代理客户端服务",
 	}
 
+	// 查询命令仅读取控制套接字路径，不打开日志文件
+	if len(os.Args) > 1 && (os.Args[1] == "status" || os.Args[1] == "tunnels") {
+		os.Exit(Command(os.Args[1], os.Args[2:]))
+	}
+	conf.Init()
+
 	prg := &Program{}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
@@ -95,20 +112,80 @@ func main() {
 // Start 启动主服务
 func Start() {
 	doRun := func(server conf.Server) {
-		addr := server.InetHost + ":" + strconv.Itoa(server.InetPort)
+		addr := net.JoinHostPort(server.InetHost, strconv.Itoa(server.InetPort))
 		tlsConfig := TlsConfig()
+		proxySetting := server.Proxy
+		if named, ok := conf.AppConf().Natok.Proxies[proxySetting]; ok {
+			proxySetting = named
+		}
+		proxy, err := core.ServerProxy(proxySetting, addr)
+		if err != nil {
+			log.Errorf("Natok server %s proxy config failed, Error: %+v", addr, err)
+			return
+		}
+		if proxy != nil {
+			log.Infof("Natok server %s via proxy %s", addr, proxy.Url.Redacted())
+		}
+		var webSocket *conf.WebSocket
+		if server.Transport == "websocket" {
+			webSocket = server.WebSocket
+			if webSocket == nil {
+				webSocket = &conf.WebSocket{}
+			}
+			if webSocket.Scheme == "ws" {
+				log.Warnf("Natok server %s uses plain ws transport, the access key is sent in cleartext, use wss instead", addr)
+			}
+		}
+		command := ""
+		if server.Transport == "command" {
+			command = server.Command
+		}
+		dialer := core.NetDialer{
+			IpVersion: server.IpVersion,
+			LocalAddr: server.LocalAddress,
+			Interface: server.Interface,
+			Socket:    core.SocketOptions(conf.AppConf().Natok.Socket, server.Socket),
+		}
+		var quicSession *core.QuicSession
+		if server.Transport == "quic" {
+			quicSession = core.NewQuicSession(addr, tlsConfig, server.Quic)
+			quicSession.Dialer = dialer
+			if proxy != nil {
+				log.Warnf("Natok server %s uses quic transport, proxy is ignored", addr)
+			}
+		}
+		connHandler := &core.ConnectHandler{Name: "Main", BufSize: dialer.Socket.BufferSize}
 		poolHandler := &core.NatokHandler{
+			AccessKey: server.AccessKey,
 			Conf: &core.NatokConnConfig{
-				Addr: addr,
-				Conf: tlsConfig,
+				Addr:      addr,
+				Conf:      tlsConfig,
+				Proxy:     proxy,
+				WebSocket: webSocket,
+				Command:   command,
+				Quic:      quicSession,
+				Dialer:    dialer,
 			},
-			Conns: make([]*core.ConnectHandler, 0, 10),
+			Conns:     make([]*core.ConnectHandler, 0, 10),
+			Main:      connHandler,
+			Negotiate: server.Features,
 		}
+		core.RegisterNatok(poolHandler)
 
-		connHandler := &core.ConnectHandler{Name: "Main"}
-
+		poolHandler.SetConnected(false)
 		for {
-			connHandler.Conn = Connect(addr, tlsConfig)
+			poolHandler.WaitResume()
+			conn := Connect(poolHandler)
+			if conn == nil {
+				continue
+			}
+			connHandler.SetConn(conn)
+			// 暂停先于记录连接时Pause未能关闭该连接，在此关闭
+			if poolHandler.Paused() {
+				connHandler.CloseConn()
+				continue
+			}
+			poolHandler.SetConnected(true)
 			natokServerHandler := &core.NatokServerHandler{
 				AccessKey:    server.AccessKey,
 				NatokHandler: poolHandler,
@@ -119,28 +196,61 @@ func Start() {
 			natokServerHandler.HeartBeat()
 			natokServerHandler.Auth()
 			connHandler.Listen()
+			poolHandler.SetConnected(false)
 		}
 	}
+	// 域名解析、内网目标及健康检查
+	natok := &conf.AppConf().Natok
+	core.InitResolver(natok.Dns)
+	core.InitAccessLog(natok.AccessLog)
+	// 配置出错的内网目标拒绝连接，错误已逐条记录
+	_ = core.InitTargets(natok.Target)
+	if addr := natok.HealthAddr; addr != "" {
+		go core.HealthServe(addr)
+	}
+	if addr := natok.MetricsAddr; addr != "" {
+		go core.MetricsServe(addr)
+	}
+	if admin := natok.Admin; admin != nil && admin.Addr != "" {
+		go core.AdminServe(admin, Reload)
+	}
+	if path := natok.ControlSocket; path != "" {
+		go core.ControlServe(path)
+	}
 	// 调用
-	for idx, server := range conf.AppConf.Natok.Server {
+	for idx, server := range natok.Server {
 		go func(ser conf.Server) { doRun(ser) }(server)
 		log.Infof("Listen: %d, %s", idx+1, server.InetHost)
 	}
 }
 
-// Connect 向NATOK-SERVER发起连接
-func Connect(addr string, conf *tls.Config) net.Conn {
+// Reload 重新加载配置：域名解析、内网目标等即时生效，natok-server列表须重启后生效
+func Reload() error {
+	if err := conf.Reload(); err != nil {
+		log.Errorf("Reload config failed, Error: %+v", err)
+		return err
+	}
+	natok := &conf.AppConf().Natok
+	core.InitResolver(natok.Dns)
+	core.InitAccessLog(natok.AccessLog)
+	if err := core.InitTargets(natok.Target); err != nil {
+		return err
+	}
+	log.Info("Config reloaded, natok-server changes take effect after restart")
+	return nil
+}
+
+// Connect 向NATOK-SERVER发起连接，暂停时放弃连接并返回nil
+func Connect(handler *core.NatokHandler) net.Conn {
 	retry := 0
+	connConf := handler.Conf
+	addr := connConf.Addr
 	for {
-		var conn net.Conn
-		var err error
-
-		if conf != nil {
-			conn, err = tls.Dial("tcp", addr, conf)
-		} else {
-			conn, err = net.Dial("tcp", addr)
+		// 重连期间被暂停时放弃连接
+		if handler.Paused() {
+			return nil
 		}
-
+		conn, err := connConf.Dial(0)
 		if err != nil {
 			retry += 1
 			if retry > 1000000 {
@@ -152,14 +262,17 @@ func Connect(addr string, conf *tls.Config) net.Conn {
 			time.Sleep(time.Second * 2)
 			continue
 		}
-
+		if handler.Paused() {
+			_ = conn.Close()
+			return nil
+		}
 		return conn
 	}
 }
 
 // TlsConfig TSL协议配置
 func TlsConfig() *tls.Config {
-	tlsConf := conf.AppConf.Natok
+	tlsConf := conf.AppConf().Natok
 	cert, err := tls.LoadX509KeyPair(tlsConf.CertPemPath, tlsConf.CertKeyPath)
 	if err != nil {
 		log.Error(err)